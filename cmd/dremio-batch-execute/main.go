@@ -15,73 +15,406 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 	"time"
 
 	"github.com/rsvihladremio/dremio-batch-execute/pkg/conf"
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/export"
 	"github.com/rsvihladremio/dremio-batch-execute/pkg/output"
 	"github.com/rsvihladremio/dremio-batch-execute/pkg/parser"
 	"github.com/rsvihladremio/dremio-batch-execute/pkg/pool"
 	"github.com/rsvihladremio/dremio-batch-execute/pkg/process"
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/progress"
 	"github.com/rsvihladremio/dremio-batch-execute/pkg/protocol"
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/retry"
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/throttle"
 )
 
+// interruptedExitCode is the exit code when a signal stopped the run before every query was run
+const interruptedExitCode = 130
+
 func main() {
-	restAPIURL := flag.String("url", "http://localhost:9047", "Dremio REST api URL")
+	restAPIURL := flag.String("url", "http://localhost:9047", "Dremio REST api URL, or the Flight SQL url such as grpc://localhost:32010 or grpc+tls://localhost:32010 with -protocol flight")
+	protocolName := flag.String("protocol", "http", "protocol to run queries with, either 'http' for the REST api, 'flight' for Arrow Flight SQL or 'sql' for the database/sql driver -sql-driver")
+	sqlDriver := flag.String("sql-driver", "", "database/sql driver for -protocol sql, one of sqlite or pgx, and odbc when built with -tags odbc")
+	sqlDSN := flag.String("sql-dsn", "", "data source name for -sql-driver, such as a file name for sqlite or a postgres:// url for pgx")
 	restAPIUsername := flag.String("user", "dremio", "User to use for operations")
 	restAPIPassword := flag.String("pass", "dremio123", "Password for -user")
-	restHTTPTimeout := flag.Duration("request-timeout", time.Minute*1, "request timeout")
-	sleepTime := flag.Duration("request-sleep-time", time.Second*1, "duration to wait after query is done to mark it as complete, this can also be used to keep from overwhelming a server")
-	threads := flag.Int("threads", 1, "number of threads to execute at once, by default 1 is recommended")
+	cloudProjectID := flag.String("cloud-project-id", "", "run the queries in this Dremio Cloud project instead of against -url, requires -auth pat")
+	cloudRegion := flag.String("cloud-region", "us", "Dremio Cloud region of -cloud-project-id, either us, eu or the API url of the control plane")
+	auth := flag.String("auth", "password", "how to authenticate: 'password' logs in with -user and -pass, 'pat' uses a personal access token and 'token-exchange' exchanges a JWT from your identity provider for a Dremio token. The token is read from -token-file or -token-env")
+	tokenFile := flag.String("token-file", "", "file with the personal access token or JWT for -auth pat or token-exchange")
+	tokenEnv := flag.String("token-env", "DREMIO_TOKEN", "environment variable with the personal access token or JWT for -auth pat or token-exchange, used when -token-file is not set")
+	skipSSL := flag.Bool("skip-ssl-verify", false, "do not verify the certificate and hostname of Dremio for https urls, only use this for testing")
+	caCertFile := flag.String("ca-cert", "", "PEM file of certificate authorities to trust for https urls in addition to the system ones")
+	clientCertFile := flag.String("client-cert", "", "PEM client certificate for mutual TLS, requires -client-key")
+	clientKeyFile := flag.String("client-key", "", "PEM key of -client-cert")
+	tlsMinVersion := flag.String("tls-min-version", "", "lowest TLS version accepted, one of 1.0, 1.1, 1.2 or 1.3, by default Go decides")
+	tlsServerName := flag.String("tls-server-name", "", "hostname to verify the certificate of Dremio against instead of the one in -url")
+	restHTTPTimeout := flag.Duration("request-timeout", time.Minute*60, "how long a query may take, including the checks of its status, before it is considered failed")
+	httpRequestTimeout := flag.Duration("http-request-timeout", time.Second*30, "how long a single HTTP request to Dremio may take before it is abandoned, -request-timeout still limits the whole query")
+	cancelTimeout := flag.Duration("cancel-timeout", time.Minute*5, "how long to wait for a query that exceeded -request-timeout to be canceled. Only a query confirmed as canceled is attempted again, so a slow query never runs twice at once")
+	pollInterval := flag.Duration("poll-interval", time.Millisecond*10, "wait before the first check of a query's status, it doubles with every check up to -max-poll-interval")
+	maxPollInterval := flag.Duration("max-poll-interval", time.Second*5, "longest wait between checks of a query's status")
+	sleepTime := flag.Duration("request-sleep-time", time.Second*1, "duration each thread waits after a query is done to mark it as complete, the actual query rate still depends on the number of threads and query latency so use -max-qps or -max-queries-per-minute for a hard limit")
+	maxQPS := flag.Float64("max-qps", 0, "maximum number of queries submitted per second across all threads, 0 is unlimited")
+	maxQueriesPerMinute := flag.Float64("max-queries-per-minute", 0, "maximum number of queries submitted per minute across all threads, 0 is unlimited. Cannot be used with -max-qps")
+	maxBurst := flag.Int("max-burst", 1, "number of queries that can be submitted at once before -max-qps or -max-queries-per-minute applies")
+	threads := flag.Int("threads", 1, "number of threads to execute at once, by default 1 is recommended. With -adaptive this is the starting concurrency")
+	adaptive := flag.Bool("adaptive", false, "adjust the number of threads running at once between -min-threads and -max-threads, growing while queued time and error rate stay under -target-latency and -max-error-rate and halving when they do not")
+	minThreads := flag.Int("min-threads", 1, "lowest number of threads running at once with -adaptive")
+	maxThreads := flag.Int("max-threads", 8, "highest number of threads running at once with -adaptive")
+	targetLatency := flag.Duration("target-latency", time.Second*30, "average time queries wait in the Dremio queue above which -adaptive reduces the number of threads, protocols that do not report the queued time use the query latency instead")
+	maxErrorRate := flag.Float64("max-error-rate", 0.05, "fraction of query submissions failing with errors that can be retried, such as timeouts or overload, above which -adaptive reduces the number of threads")
+	adjustInterval := flag.Duration("adjust-interval", time.Second*30, "how often -adaptive adjusts the number of threads")
+	maxAttempts := flag.Int("max-attempts", 3, "number of times a query is attempted before it is recorded as failed. Queries that fail with validation, parse or permission errors are not attempted again")
+	retryBackoff := flag.Duration("retry-backoff", time.Second*1, "wait before attempting a failed query again, it doubles for every attempt after that with a random part taken off")
+	retryMaxBackoff := flag.Duration("retry-max-backoff", time.Minute*1, "longest wait before attempting a failed query again")
+	gracePeriod := flag.Duration("shutdown-grace-period", time.Second*30, "on SIGINT or SIGTERM no new queries are started and running queries have this long to finish before they are canceled")
 	// commenting batch size until we implement odbc, we can just set a default value for the meantime
 	// batchSize := flag.Int("batch-size", 1, "number of sql statements to execute at once")
 	batchSize := 1
-	sourceQueryFile := flag.String("source-file", "queries.sql", "file with a list of queries to execute. Each query must be terminated by a ; or be on only one line. Queries must be unique for resume support to work correctly")
-	progressFilePath := flag.String("query-progress-file", "queries-completed.txt", "the file that logs all completed queries, will prevent completed queries in the source file from being retried. Multiple invocations of dremio-batch-execute for the same progress file may result in corruption")
+	queryContext := flag.String("context", "", "path unqualified names in the queries are resolved in, such as space.folder, double quote a part with a '.' in it. A '-- @context: path' annotation sets it for one statement and '-- @default-context: path' for that statement and the ones after it in the file")
+	references := flag.String("references", "", "versions of Nessie or Arctic sources the queries run against as a comma separated list of source=branch:name, source=tag:name or source=commit:hash. A '-- @references: list' annotation overrides them for one statement and '-- @default-references: list' for that statement and the ones after it in the file")
+	sourceQueryFile := flag.String("source-file", "queries.sql", "file with a list of queries to execute. Each query must be terminated by a ;, several queries may share a line. Queries must be unique for resume support to work correctly")
+	progressFormat := flag.String("progress-format", "text", "format of the progress file, either 'text' which lists each completed query or 'jsonl' which records the timing, attempts and state of each query. An existing progress file keeps its format")
+	progressHashOnly := flag.Bool("progress-hash-only", false, "record only a SHA-256 hash of each completed query in the progress file instead of the full query text")
+	allowUnterminated := flag.Bool("allow-unterminated", false, "accept a final query in the source file that is not terminated by a ;, by default this is an error so that the query is not silently skipped")
+	progressFilePath := flag.String("query-progress-file", "queries-completed.txt", "the file that logs all completed queries, will prevent completed queries in the source file from being retried. The file is locked while in use so only one invocation of dremio-batch-execute can use it at a time")
+	progressSyncEvery := flag.Int("progress-fsync-every", 1, "flush the progress file to disk after this many completed queries, 1 flushes every query and 0 disables it")
+	progressSyncInterval := flag.Duration("progress-fsync-interval", 0, "flush the progress file to disk at least this often, 0 disables it")
+	resultsDir := flag.String("results-dir", "", "directory to write the rows returned by each SELECT to, one file per statement named after its '-- @label: name' annotation and the start of the hash of the statement, or else the whole hash. Statements whose results file already exists are skipped. Only supported with -protocol http and flight")
+	resultsFormat := flag.String("results-format", "csv", "format of the files in -results-dir, one of csv, jsonl or parquet")
+	failedFilePath := flag.String("failed-file", "", "file to write the queries that failed to, each with the error as a comment, so it can be fixed and used as the -source-file of another run. It is replaced on every run, by default failed queries are only logged")
+	forceUnlock := flag.Bool("force-unlock", false, "take over the lock on the progress file even when the run that holds it cannot be verified as stopped, only use this when that run is known to be gone")
 	flag.Parse()
 	args := conf.Args{
 		DremioUsername:   *restAPIUsername,
 		DremioPassword:   *restAPIPassword,
 		DremioURL:        *restAPIURL,
+		Protocol:         *protocolName,
+		SQLDriver:        *sqlDriver,
+		SQLDSN:           *sqlDSN,
+		QueryContext:     *queryContext,
+		References:       *references,
 		HTTPTimeout:      *restHTTPTimeout,
+		CancelTimeout:    *cancelTimeout,
+		PollInterval:     *pollInterval,
+		MaxPollInterval:  *maxPollInterval,
+		CloudProjectID:   *cloudProjectID,
+		CloudRegion:      *cloudRegion,
+		Auth:             *auth,
+		TokenFile:        *tokenFile,
+		TokenEnv:         *tokenEnv,
+		SkipSSL:          *skipSSL,
+		CACertFile:       *caCertFile,
+		ClientCertFile:   *clientCertFile,
+		ClientKeyFile:    *clientKeyFile,
+		TLSMinVersion:    *tlsMinVersion,
+		TLSServerName:    *tlsServerName,
 		RequestSleepTime: *sleepTime,
 		RequestThreads:   *threads,
 		SourceQueryFile:  *sourceQueryFile,
 		ProgressFilePath: *progressFilePath,
 		BatchSize:        batchSize,
+
+		AllowUnterminated: *allowUnterminated,
+		ProgressHashOnly:  *progressHashOnly,
+		ProgressFormat:    *progressFormat,
+		ForceUnlock:       *forceUnlock,
+		FailedFilePath:    *failedFilePath,
+		ResultsDir:        *resultsDir,
+		ResultsFormat:     *resultsFormat,
+
+		MaxQPS:              *maxQPS,
+		MaxQueriesPerMinute: *maxQueriesPerMinute,
+		MaxBurst:            *maxBurst,
+
+		Adaptive:       *adaptive,
+		MinThreads:     *minThreads,
+		MaxThreads:     *maxThreads,
+		TargetLatency:  *targetLatency,
+		MaxErrorRate:   *maxErrorRate,
+		AdjustInterval: *adjustInterval,
+
+		MaxAttempts:     *maxAttempts,
+		RetryBackoff:    *retryBackoff,
+		RetryMaxBackoff: *retryMaxBackoff,
+
+		ShutdownGracePeriod: *gracePeriod,
+
+		HTTPRequestTimeout: *httpRequestTimeout,
+
+		ProgressSyncEvery:    *progressSyncEvery,
+		ProgressSyncInterval: *progressSyncInterval,
 	}
 	output.LogStartMessage(args)
-	if err := Execute(args); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		// a second signal stops the process straight away
+		stop()
+	}()
+	err := Execute(ctx, args)
+	stop()
+	if errors.Is(err, process.ErrInterrupted) {
+		log.Print(err)
+		os.Exit(interruptedExitCode)
+	}
+	if err != nil {
 		log.Fatal(err)
 	}
 }
 
-func Execute(args conf.Args) error {
+func Execute(ctx context.Context, args conf.Args) error {
+	auth, err := protocol.ParseAuth(args.Auth)
+	if err != nil {
+		return err
+	}
+	var token string
+	if auth != protocol.AuthPassword {
+		token, err = protocol.LoadToken(args.TokenFile, args.TokenEnv)
+		if err != nil {
+			return err
+		}
+	}
 	httpArgs := conf.ProtocolArgs{
+		Auth:     auth,
+		Token:    token,
 		User:     args.DremioUsername,
 		Password: args.DremioPassword,
 		URL:      args.DremioURL,
-		SkipSSL:  true,
+		SkipSSL:  args.SkipSSL,
 		Timeout:  args.HTTPTimeout,
+
+		PollInterval:    args.PollInterval,
+		MaxPollInterval: args.MaxPollInterval,
+		CACertFile:      args.CACertFile,
+		ClientCertFile:  args.ClientCertFile,
+		ClientKeyFile:   args.ClientKeyFile,
+		TLSMinVersion:   args.TLSMinVersion,
+		TLSServerName:   args.TLSServerName,
+		CancelTimeout:   args.CancelTimeout,
+		RequestTimeout:  args.HTTPRequestTimeout,
+	}
+	queryContext, err := protocol.ParseContext(args.QueryContext)
+	if err != nil {
+		return err
 	}
-	eng, err := protocol.NewHTTPEngine(httpArgs)
+	references, err := protocol.ParseReferences(args.References)
+	if err != nil {
+		return err
+	}
+	eng, err := newEngine(args, httpArgs)
 	if err != nil {
 		return fmt.Errorf("unable to configure engine: %v", err)
 	}
+	if closer, ok := eng.(io.Closer); ok {
+		defer func() {
+			if err := closer.Close(); err != nil {
+				log.Printf("WARN: unable to close connection to Dremio: %v", err)
+			}
+		}()
+	}
+	if _, ok := eng.(protocol.QueryExecutor); !ok && (len(queryContext) > 0 || len(references) > 0) {
+		return fmt.Errorf("-context and -references are not supported with the %v protocol", eng.Name())
+	}
 
-	queries, err := parser.ReadQueriesWithProgressFileFiltering(args)
+	lock, err := progress.AcquireLock(args.ProgressFilePath, args.ForceUnlock)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := lock.Release(); err != nil {
+			log.Printf("WARN: unable to release lock on progress file: %v", err)
+		}
+	}()
+	progressFormat, err := progress.ParseFormat(args.ProgressFormat)
+	if err != nil {
+		return err
+	}
+	recorder, err := progress.OpenRecorder(args.ProgressFilePath, progressFormat, args.ProgressHashOnly, progress.SyncPolicy{
+		EveryRecords: args.ProgressSyncEvery,
+		Interval:     args.ProgressSyncInterval,
+	})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := recorder.Close(); err != nil {
+			log.Printf("WARN: unable to close progress file: %v", err)
+		}
+	}()
+	if recorder.Format() != progressFormat {
+		log.Printf("progress file %v is already in the %v format, continuing to use it", args.ProgressFilePath, recorder.Format())
+	}
+	completed, err := progress.LoadIndex(args.ProgressFilePath)
+	if err != nil {
+		return err
+	}
+	queries, err := parser.NewQuerySource(args, completed)
 	if err != nil {
 		return fmt.Errorf("parsing error: %v", err)
 	}
-	queryPool, err := pool.DivideQueries(args.RequestThreads, queries)
+	defer queries.Close()
+	threads := args.RequestThreads
+	var controller *pool.Controller
+	if args.Adaptive {
+		controller, err = pool.NewController(pool.ControllerConfig{
+			Initial:       args.RequestThreads,
+			Min:           args.MinThreads,
+			Max:           args.MaxThreads,
+			TargetLatency: args.TargetLatency,
+			MaxErrorRate:  args.MaxErrorRate,
+			Interval:      args.AdjustInterval,
+		})
+		if err != nil {
+			return err
+		}
+		// start every thread the controller may ever allow, it decides how many run at once
+		threads = args.MaxThreads
+		controller.Start()
+		defer controller.Stop()
+	}
+	queryPool, err := pool.NewPool(threads, queries)
 	if err != nil {
 		return err
 	}
+	defer queryPool.Stop()
+
+	var failedWriter *progress.FailedWriter
+	if args.FailedFilePath != "" {
+		if err := checkFailedFile(args); err != nil {
+			return err
+		}
+		failedWriter, err = progress.CreateFailedWriter(args.FailedFilePath)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := failedWriter.Close(); err != nil {
+				log.Printf("WARN: unable to close failed query file: %v", err)
+			}
+		}()
+	}
+
+	limiter, err := newLimiter(args)
+	if err != nil {
+		return err
+	}
+
+	results, err := newExporter(args, eng)
+	if err != nil {
+		return err
+	}
+
+	if err := process.Execute(ctx, eng, queryPool, process.Options{
+		SleepTime:    args.RequestSleepTime,
+		Recorder:     recorder,
+		FailedWriter: failedWriter,
+		Limiter:      limiter,
+		Controller:   controller,
+		Retry: retry.Policy{
+			MaxAttempts:    args.MaxAttempts,
+			InitialBackoff: args.RetryBackoff,
+			MaxBackoff:     args.RetryMaxBackoff,
+		},
+		GracePeriod: args.ShutdownGracePeriod,
+		Results:     results,
+		Context:     queryContext,
+		References:  references,
+	}); err != nil {
+		return fmt.Errorf("process failure: %w", err)
+	}
+	return nil
+}
+
+// newEngine creates the engine for the protocol and deployment in the args
+func newEngine(args conf.Args, protocolArgs conf.ProtocolArgs) (protocol.Engine, error) {
+	switch args.Protocol {
+	case "", "http":
+		if args.CloudProjectID == "" {
+			return protocol.NewHTTPEngine(protocolArgs)
+		}
+		cloudURL, err := protocol.CloudURL(args.CloudRegion)
+		if err != nil {
+			return nil, err
+		}
+		protocolArgs.URL = cloudURL
+		protocolArgs.ProjectID = args.CloudProjectID
+		return protocol.NewCloudEngine(protocolArgs)
+	case "flight":
+		if args.CloudProjectID != "" {
+			return nil, errors.New("-protocol flight cannot be used with -cloud-project-id")
+		}
+		return protocol.NewFlightEngine(protocolArgs)
+	case "sql":
+		protocolArgs.Driver = args.SQLDriver
+		protocolArgs.DSN = args.SQLDSN
+		return protocol.NewSQLEngine(protocolArgs)
+	default:
+		return nil, fmt.Errorf("unknown protocol '%v', use http, flight or sql", args.Protocol)
+	}
+}
 
-	if err := process.Execute(eng, args.RequestSleepTime, args.ProgressFilePath, queryPool); err != nil {
-		return fmt.Errorf("process failure: %v", err)
+// newExporter creates the exporter of query results, it is nil when no results directory is configured
+func newExporter(args conf.Args, eng protocol.Engine) (*export.Exporter, error) {
+	if args.ResultsDir == "" {
+		return nil, nil
+	}
+	// engines that stream the rows back while the query runs need no reader
+	reader, ok := eng.(protocol.ResultReader)
+	if _, streams := eng.(protocol.ResultStreamer); !ok && !streams {
+		return nil, fmt.Errorf("-results-dir is not supported with the %v protocol", eng.Name())
+	}
+	format, err := export.ParseFormat(args.ResultsFormat)
+	if err != nil {
+		return nil, err
+	}
+	return export.NewExporter(args.ResultsDir, format, reader)
+}
+
+// checkFailedFile makes sure the failed query file is not one of the files it would replace
+func checkFailedFile(args conf.Args) error {
+	failedPath, err := filepath.Abs(args.FailedFilePath)
+	if err != nil {
+		return err
+	}
+	for _, p := range []string{args.SourceQueryFile, args.ProgressFilePath} {
+		other, err := filepath.Abs(p)
+		if err != nil {
+			return err
+		}
+		if failedPath == other {
+			return fmt.Errorf("the failed query file %v cannot also be the source or progress file", args.FailedFilePath)
+		}
 	}
 	return nil
 }
+
+// newLimiter creates the limiter shared by all threads, it is nil when no rate limit is configured
+func newLimiter(args conf.Args) (*throttle.Limiter, error) {
+	if args.MaxQPS < 0 || args.MaxQueriesPerMinute < 0 {
+		return nil, errors.New("query rate limits cannot be negative")
+	}
+	if args.MaxQPS > 0 && args.MaxQueriesPerMinute > 0 {
+		return nil, errors.New("only one of -max-qps and -max-queries-per-minute can be set")
+	}
+	perSecond := args.MaxQPS
+	if args.MaxQueriesPerMinute > 0 {
+		perSecond = args.MaxQueriesPerMinute / 60
+	}
+	if perSecond == 0 {
+		return nil, nil
+	}
+	return throttle.NewLimiter(perSecond, args.MaxBurst), nil
+}
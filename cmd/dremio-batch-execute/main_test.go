@@ -16,6 +16,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"log"
 	"os"
 	"path/filepath"
@@ -39,7 +40,7 @@ func cleanup(t *testing.T) {
 			log.Printf("WARN: unable to remove progress file `%v` with error: %v", progressFile, err)
 		}
 	}()
-	err := Execute(conf.Args{
+	err := Execute(context.Background(), conf.Args{
 		DremioUsername:   "dremio",
 		DremioPassword:   "dremio123",
 		DremioURL:        "http://localhost:9047",
@@ -67,7 +68,7 @@ func setup(t *testing.T) {
 	if err != nil {
 		t.Fatalf("cleanup failure on new http engine: %v", err)
 	}
-	if err := eng.MakeSource("a"); err != nil {
+	if err := eng.MakeSource(context.Background(), "a"); err != nil {
 		t.Logf("WARN: unable to make source: %v", err)
 	}
 	time.Sleep(100 * time.Millisecond)
@@ -75,7 +76,7 @@ func setup(t *testing.T) {
 	srcFile := "testdata/create.sql"
 
 	progressFile := filepath.Join(t.TempDir(), "progress-create.txt")
-	err = Execute(conf.Args{
+	err = Execute(context.Background(), conf.Args{
 		DremioUsername:   "dremio",
 		DremioPassword:   "dremio123",
 		DremioURL:        "http://localhost:9047",
@@ -97,7 +98,7 @@ func TestExecute(t *testing.T) {
 	setup(t)
 	srcFile := "testdata/queries.sql"
 	progressFile := filepath.Join(t.TempDir(), "progress-default.txt")
-	err := Execute(conf.Args{
+	err := Execute(context.Background(), conf.Args{
 		DremioUsername:   "dremio",
 		DremioPassword:   "dremio123",
 		DremioURL:        "http://localhost:9047",
@@ -129,7 +130,7 @@ func TestExecuteWithThreads(t *testing.T) {
 
 	srcFile := "testdata/threading/queries.sql"
 	progressFile := filepath.Join(t.TempDir(), "progress-threads.txt")
-	err := Execute(conf.Args{
+	err := Execute(context.Background(), conf.Args{
 		DremioUsername:   "dremio",
 		DremioPassword:   "dremio123",
 		DremioURL:        "http://localhost:9047",
@@ -175,7 +176,7 @@ func TestExecuteWithResume(t *testing.T) {
 	setup(t)
 	srcFile := "testdata/resume/queries.sql"
 	progressFile := filepath.Join(t.TempDir(), "progress-resume.txt")
-	err := Execute(conf.Args{
+	err := Execute(context.Background(), conf.Args{
 		DremioUsername:   "dremio",
 		DremioPassword:   "dremio123",
 		DremioURL:        "http://localhost:9047",
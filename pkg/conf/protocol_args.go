@@ -26,13 +26,101 @@ type Args struct {
 	SourceQueryFile  string
 	ProgressFilePath string
 	BatchSize        int
+	// AllowUnterminated accepts a final statement in SourceQueryFile that has no terminating ';'
+	AllowUnterminated bool
+	// ProgressHashOnly records a hash of each completed query in ProgressFilePath instead of its text
+	ProgressHashOnly bool
+	// ProgressFormat is the format used for a new ProgressFilePath, either "text" or "jsonl"
+	ProgressFormat string
+	// ForceUnlock takes over the lock on ProgressFilePath from a run that cannot be verified as stopped
+	ForceUnlock bool
+	// ProgressSyncEvery flushes ProgressFilePath to disk after this many records, 0 disables it
+	ProgressSyncEvery int
+	// ProgressSyncInterval flushes ProgressFilePath to disk at least this often, 0 disables it
+	ProgressSyncInterval time.Duration
+	// FailedFilePath collects the queries that failed so they can be run again, blank disables it
+	FailedFilePath string
+	// ResultsDir receives a file with the rows of each statement that returns rows, blank disables it.
+	// ResultsFormat is csv, jsonl or parquet
+	ResultsDir    string
+	ResultsFormat string
+	// MaxQPS limits the queries submitted per second across all threads, 0 is unlimited
+	MaxQPS float64
+	// MaxQueriesPerMinute limits the queries submitted per minute across all threads, 0 is unlimited
+	MaxQueriesPerMinute float64
+	// MaxBurst is the number of queries that can be submitted at once before the rate limit applies
+	MaxBurst int
+	// Adaptive adjusts the number of threads running at once between MinThreads and MaxThreads
+	Adaptive       bool
+	MinThreads     int
+	MaxThreads     int
+	TargetLatency  time.Duration
+	MaxErrorRate   float64
+	AdjustInterval time.Duration
+	// MaxAttempts is the number of times a query is attempted before it is recorded as failed
+	MaxAttempts int
+	// RetryBackoff is the wait before the second attempt, it doubles for every attempt after that up to RetryMaxBackoff
+	RetryBackoff    time.Duration
+	RetryMaxBackoff time.Duration
+	// ShutdownGracePeriod is how long running queries have to finish after SIGINT or SIGTERM before they are canceled
+	ShutdownGracePeriod time.Duration
+	// PollInterval is the wait before the first check of a query's status, it doubles with every check up to MaxPollInterval
+	PollInterval    time.Duration
+	MaxPollInterval time.Duration
+	// SkipSSL and the TLS settings secure the connection to Dremio, see ProtocolArgs
+	SkipSSL        bool
+	CACertFile     string
+	ClientCertFile string
+	ClientKeyFile  string
+	TLSMinVersion  string
+	TLSServerName  string
+	// Auth is how to authenticate, password by default. The token for the other modes is read from
+	// TokenFile or the TokenEnv environment variable
+	Auth      string
+	TokenFile string
+	TokenEnv  string
+	// CloudProjectID runs the queries in a Dremio Cloud project instead of against DremioURL,
+	// CloudRegion is us, eu or the API url of the control plane
+	CloudProjectID string
+	CloudRegion    string
+	// Protocol runs the queries with the REST api when it is http or blank, with Arrow Flight SQL when it is flight
+	// and with the database/sql driver SQLDriver connecting to SQLDSN when it is sql
+	Protocol  string
+	SQLDriver string
+	SQLDSN    string
+	// CancelTimeout is how long to wait for a query that timed out to be canceled before giving up on it
+	CancelTimeout time.Duration
+	// QueryContext is the dotted path queries run in and References the versions of sources they run against,
+	// such as lake=branch:dev, annotations of the statements override both
+	QueryContext string
+	References   string
+	// HTTPRequestTimeout is how long a single HTTP request to Dremio may take, HTTPTimeout still limits the whole query
+	HTTPRequestTimeout time.Duration
 }
 
 // ProtocolArgs provides a way to configure the communication protocol
 type ProtocolArgs struct {
-	User     string        // User for Dremio to ues to execute the queries in stress.json
-	Password string        // Password for Dremio to use to execute the queries in stress.json
-	URL      string        // URL either HTTP URL
-	SkipSSL  bool          // SkipSSL avoids validating certificates and hostname for HTTPS
-	Timeout  time.Duration // Timeout duration for requests (in the case of HTTP will be each request, included checks for query status
+	Auth     string // Auth is how to authenticate, see protocol.ParseAuth
+	Token    string // Token is the personal access token or the JWT to exchange, depending on Auth
+	User     string // User for Dremio to ues to execute the queries in stress.json
+	Password string // Password for Dremio to use to execute the queries in stress.json
+	URL      string // URL either HTTP URL or the grpc:// or grpc+tls:// URL of Flight SQL
+	// ProjectID is the Dremio Cloud project to run queries in, blank for Dremio Software
+	ProjectID string
+	SkipSSL   bool          // SkipSSL avoids validating certificates and hostname for HTTPS
+	Timeout   time.Duration // Timeout is how long a query may take, including the checks of its status
+	// PollInterval is the wait before the first check of a query's status, it doubles with every check up to MaxPollInterval
+	PollInterval    time.Duration
+	MaxPollInterval time.Duration
+	CACertFile      string // CACertFile is a PEM bundle of certificate authorities trusted in addition to the system ones
+	ClientCertFile  string // ClientCertFile is a PEM client certificate for mutual TLS, it needs ClientKeyFile
+	ClientKeyFile   string // ClientKeyFile is the PEM key of ClientCertFile
+	TLSMinVersion   string // TLSMinVersion is the lowest TLS version accepted, such as 1.2, blank leaves it to Go
+	TLSServerName   string // TLSServerName overrides the hostname the certificate of Dremio is checked against
+	Driver          string // Driver is the registered database/sql driver of the sql protocol
+	DSN             string // DSN is the data source name passed to Driver
+	// CancelTimeout is how long to wait for a query that timed out to be canceled before giving up on it
+	CancelTimeout time.Duration
+	// RequestTimeout is how long a single HTTP request to Dremio may take, Timeout still limits the whole query
+	RequestTimeout time.Duration
 }
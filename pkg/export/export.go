@@ -0,0 +1,183 @@
+//	Copyright 2023 Dremio Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package export writes the rows returned by queries to files, one file per statement
+package export
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/parser"
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/progress"
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/protocol"
+)
+
+// Format of the exported results
+type Format string
+
+const (
+	FormatCSV     Format = "csv"     // FormatCSV writes a header with the column names and then one line per row
+	FormatJSONL   Format = "jsonl"   // FormatJSONL writes one JSON object per row
+	FormatParquet Format = "parquet" // FormatParquet writes a Parquet file typed from the schema of the results
+)
+
+// ParseFormat validates a format name, a blank name is FormatCSV
+func ParseFormat(name string) (Format, error) {
+	switch Format(name) {
+	case "", FormatCSV:
+		return FormatCSV, nil
+	case FormatJSONL, FormatParquet:
+		return Format(name), nil
+	}
+	return "", fmt.Errorf("unsupported results format '%v' only '%v', '%v' and '%v' are supported", name, FormatCSV, FormatJSONL, FormatParquet)
+}
+
+// partialSuffix marks a results file that is still being written, it is renamed once every row is written
+const partialSuffix = ".partial"
+
+// Exporter writes the results of each statement that returns rows to its own file in a directory
+type Exporter struct {
+	dir    string
+	format Format
+	reader protocol.ResultReader
+}
+
+// NewExporter creates the directory if needed and returns an Exporter reading results with reader, which may
+// be nil when the results are only written with Stream
+func NewExporter(dir string, format Format, reader protocol.ResultReader) (*Exporter, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, fmt.Errorf("unable to create results directory %v: %w", dir, err)
+	}
+	return &Exporter{
+		dir:    dir,
+		format: format,
+		reader: reader,
+	}, nil
+}
+
+// Exports is true for statements whose results are written to a file
+func (e *Exporter) Exports(statement parser.Statement) bool {
+	return e != nil && parser.ReturnsRows(statement.SQL)
+}
+
+// labelHashLength is how much of the statement hash follows the label in a file name
+const labelHashLength = 8
+
+// Path is the file the results of the statement are written to. It is named after the label annotation
+// of the statement followed by the start of the statement hash, so a file written for a statement that
+// has since been edited is not taken for its results, or the whole hash when it has no label
+func (e *Exporter) Path(statement parser.Statement) string {
+	hash := progress.Hash(statement.SQL)
+	name := hash
+	if label := fileName(statement.Annotations[parser.AnnotationLabel]); label != "" {
+		name = label + "-" + hash[:labelHashLength]
+	}
+	return filepath.Join(e.dir, name+"."+string(e.format))
+}
+
+// fileName keeps the letters, digits, '.', '_' and '-' of a label and replaces anything else with '_'
+func fileName(label string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '_', r == '-':
+			return r
+		}
+		return '_'
+	}, label)
+	if strings.Trim(name, ".") == "" {
+		return ""
+	}
+	return name
+}
+
+// Written is true when every row of the statement's results was already written, by an earlier run for example
+func (e *Exporter) Written(statement parser.Statement) (bool, error) {
+	_, err := os.Stat(e.Path(statement))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Export reads the results of the job and writes them to the statement's file, see Stream
+func (e *Exporter) Export(ctx context.Context, statement parser.Statement, jobID string) (int64, error) {
+	if e.reader == nil {
+		return 0, fmt.Errorf("unable to read the results of job %v", jobID)
+	}
+	rows, err := e.Stream(statement, func(page func(protocol.ResultPage) error) error {
+		return e.reader.ReadResults(ctx, jobID, page)
+	})
+	if errors.Is(err, errNoResults) {
+		return 0, fmt.Errorf("no results were returned for job %v", jobID)
+	}
+	return rows, err
+}
+
+// errNoResults is returned by Stream when read never produced a page
+var errNoResults = errors.New("no results were returned")
+
+// Stream writes every page read produces to the statement's file, see Path, returning the number of rows
+// written. The rows are written to a .partial file first so a file with the final name always holds every row
+func (e *Exporter) Stream(statement parser.Statement, read func(page func(protocol.ResultPage) error) error) (rows int64, err error) {
+	path := e.Path(statement)
+	partial := path + partialSuffix
+	f, err := os.Create(partial)
+	if err != nil {
+		return 0, fmt.Errorf("unable to create results file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(partial)
+		}
+	}()
+	var w rowWriter
+	err = read(func(page protocol.ResultPage) error {
+		if w == nil {
+			var err error
+			// the writer must not close the file, that is left to Export
+			w, err = newRowWriter(e.format, struct{ io.Writer }{f}, page.Schema)
+			if err != nil {
+				return err
+			}
+		}
+		rows += int64(len(page.Rows))
+		return w.Write(page.Rows)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if w == nil {
+		return 0, errNoResults
+	}
+	if err := w.Close(); err != nil {
+		return 0, fmt.Errorf("unable to write results file %v: %w", partial, err)
+	}
+	if err := f.Sync(); err != nil {
+		return 0, fmt.Errorf("unable to flush results file %v: %w", partial, err)
+	}
+	if err := f.Close(); err != nil {
+		return 0, fmt.Errorf("unable to close results file %v: %w", partial, err)
+	}
+	if err := os.Rename(partial, path); err != nil {
+		return 0, fmt.Errorf("unable to rename results file %v: %w", partial, err)
+	}
+	return rows, nil
+}
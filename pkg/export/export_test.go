@@ -0,0 +1,254 @@
+//	Copyright 2023 Dremio Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/apache/arrow/go/v17/arrow"
+	"github.com/apache/arrow/go/v17/arrow/array"
+	"github.com/apache/arrow/go/v17/arrow/memory"
+	"github.com/apache/arrow/go/v17/parquet"
+	"github.com/apache/arrow/go/v17/parquet/file"
+	"github.com/apache/arrow/go/v17/parquet/pqarrow"
+
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/export"
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/parser"
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/progress"
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/protocol"
+)
+
+// fakeReader returns its pages in order and then fails with err when it is set
+type fakeReader struct {
+	pages []protocol.ResultPage
+	err   error
+}
+
+func (f *fakeReader) ReadResults(_ context.Context, _ string, page func(protocol.ResultPage) error) error {
+	for _, p := range f.pages {
+		if err := page(p); err != nil {
+			return err
+		}
+	}
+	return f.err
+}
+
+var schema = []protocol.Column{
+	{Name: "id", Type: "BIGINT"},
+	{Name: "name", Type: "VARCHAR"},
+	{Name: "price", Type: "DOUBLE"},
+	{Name: "day", Type: "DATE"},
+	{Name: "at", Type: "TIMESTAMP"},
+	{Name: "active", Type: "BOOLEAN"},
+	{Name: "tags", Type: "LIST"},
+}
+
+func row(values map[string]string) map[string]json.RawMessage {
+	r := make(map[string]json.RawMessage)
+	for k, v := range values {
+		r[k] = json.RawMessage(v)
+	}
+	return r
+}
+
+func pages() []protocol.ResultPage {
+	return []protocol.ResultPage{
+		{Schema: schema, Rows: []map[string]json.RawMessage{
+			row(map[string]string{"id": "1", "name": `"a, \"quoted\""`, "price": "1.5", "day": `"2023-01-02"`, "at": `"2023-01-02 03:04:05.678"`, "active": "true", "tags": `["x","y"]`}),
+		}},
+		{Schema: schema, Rows: []map[string]json.RawMessage{
+			row(map[string]string{"id": "2", "name": "null"}),
+		}},
+	}
+}
+
+func newExporter(t *testing.T, format export.Format, reader protocol.ResultReader) *export.Exporter {
+	t.Helper()
+	e, err := export.NewExporter(filepath.Join(t.TempDir(), "results"), format, reader)
+	if err != nil {
+		t.Fatalf("unable to setup test %v", err)
+	}
+	return e
+}
+
+func TestParseFormat(t *testing.T) {
+	for name, expected := range map[string]export.Format{"": export.FormatCSV, "csv": export.FormatCSV, "jsonl": export.FormatJSONL, "parquet": export.FormatParquet} {
+		if actual, err := export.ParseFormat(name); err != nil || actual != expected {
+			t.Errorf("expected %v for '%v' but was %v with error %v", expected, name, actual, err)
+		}
+	}
+	if _, err := export.ParseFormat("xlsx"); err == nil {
+		t.Error("expected an error for an unsupported format")
+	}
+}
+
+func TestPath(t *testing.T) {
+	e := newExporter(t, export.FormatCSV, &fakeReader{})
+	tests := []struct {
+		statement parser.Statement
+		name      string
+	}{
+		{statement: parser.Statement{SQL: "SELECT 1;", Annotations: map[string]string{"label": "daily_sales"}}, name: "daily_sales-" + progress.Hash("SELECT 1;")[:8] + ".csv"},
+		{statement: parser.Statement{SQL: "SELECT 2;", Annotations: map[string]string{"label": "daily_sales"}}, name: "daily_sales-" + progress.Hash("SELECT 2;")[:8] + ".csv"},
+		{statement: parser.Statement{SQL: "SELECT 1;", Annotations: map[string]string{"label": "../sales 2023"}}, name: ".._sales_2023-" + progress.Hash("SELECT 1;")[:8] + ".csv"},
+		{statement: parser.Statement{SQL: "SELECT 1;", Annotations: map[string]string{"label": ".."}}, name: progress.Hash("SELECT 1;") + ".csv"},
+		{statement: parser.Statement{SQL: "SELECT 1;"}, name: progress.Hash("SELECT 1;") + ".csv"},
+	}
+	for _, tt := range tests {
+		if actual := filepath.Base(e.Path(tt.statement)); actual != tt.name {
+			t.Errorf("expected %v but was %v", tt.name, actual)
+		}
+		if filepath.Dir(e.Path(tt.statement)) == "." {
+			t.Errorf("expected %v to be in the results directory", e.Path(tt.statement))
+		}
+	}
+}
+
+func TestExports(t *testing.T) {
+	var disabled *export.Exporter
+	if disabled.Exports(parser.Statement{SQL: "SELECT 1;"}) {
+		t.Error("expected a nil exporter to export nothing")
+	}
+	e := newExporter(t, export.FormatCSV, &fakeReader{})
+	if !e.Exports(parser.Statement{SQL: "SELECT 1;"}) {
+		t.Error("expected a SELECT to be exported")
+	}
+	if e.Exports(parser.Statement{SQL: "DROP TABLE t;"}) {
+		t.Error("expected a DROP not to be exported")
+	}
+}
+
+func TestExportText(t *testing.T) {
+	tests := []struct {
+		format   export.Format
+		expected string
+	}{
+		{
+			format: export.FormatCSV,
+			expected: "id,name,price,day,at,active,tags\n" +
+				"1,\"a, \"\"quoted\"\"\",1.5,2023-01-02,2023-01-02 03:04:05.678,true,\"[\"\"x\"\",\"\"y\"\"]\"\n" +
+				"2,,,,,,\n",
+		},
+		{
+			format: export.FormatJSONL,
+			expected: `{"id":1,"name":"a, \"quoted\"","price":1.5,"day":"2023-01-02","at":"2023-01-02 03:04:05.678","active":true,"tags":["x","y"]}` + "\n" +
+				`{"id":2,"name":null,"price":null,"day":null,"at":null,"active":null,"tags":null}` + "\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.format), func(t *testing.T) {
+			e := newExporter(t, tt.format, &fakeReader{pages: pages()})
+			statement := parser.Statement{SQL: "SELECT * FROM t;"}
+			rows, err := e.Export(context.Background(), statement, "job1")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if rows != 2 {
+				t.Errorf("expected 2 rows but was %v", rows)
+			}
+			b, err := os.ReadFile(e.Path(statement))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(b) != tt.expected {
+				t.Errorf("expected\n%q\nbut was\n%q", tt.expected, b)
+			}
+			if written, err := e.Written(statement); err != nil || !written {
+				t.Errorf("expected the results to be written but was %v with error %v", written, err)
+			}
+		})
+	}
+}
+
+func TestExportParquet(t *testing.T) {
+	e := newExporter(t, export.FormatParquet, &fakeReader{pages: pages()})
+	statement := parser.Statement{SQL: "SELECT * FROM t;"}
+	if _, err := e.Export(context.Background(), statement, "job1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	f, err := os.Open(e.Path(statement))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer f.Close()
+	table, err := pqarrow.ReadTable(context.Background(), f, parquet.NewReaderProperties(memory.DefaultAllocator), pqarrow.ArrowReadProperties{}, memory.DefaultAllocator)
+	if err != nil {
+		t.Fatalf("unable to read parquet file: %v", err)
+	}
+	defer table.Release()
+	if table.NumRows() != 2 {
+		t.Errorf("expected 2 rows but was %v", table.NumRows())
+	}
+	pf, err := file.OpenParquetFile(e.Path(statement), false)
+	if err != nil {
+		t.Fatalf("unable to open parquet file: %v", err)
+	}
+	defer pf.Close()
+	// both pages fit in a single row group
+	if pf.NumRowGroups() != 1 {
+		t.Errorf("expected 1 row group but was %v", pf.NumRowGroups())
+	}
+	expectedTypes := []arrow.DataType{
+		arrow.PrimitiveTypes.Int64,
+		arrow.BinaryTypes.String,
+		arrow.PrimitiveTypes.Float64,
+		arrow.FixedWidthTypes.Date32,
+		arrow.FixedWidthTypes.Timestamp_ms,
+		arrow.FixedWidthTypes.Boolean,
+		arrow.BinaryTypes.String,
+	}
+	for i, expected := range expectedTypes {
+		if actual := table.Schema().Field(i).Type; !arrow.TypeEqual(expected, actual) {
+			t.Errorf("expected column %v to be %v but was %v", table.Schema().Field(i).Name, expected, actual)
+		}
+	}
+	ids := table.Column(0).Data().Chunk(0).(*array.Int64)
+	if ids.Value(0) != 1 {
+		t.Errorf("expected the first id to be 1 but was %v", ids.Value(0))
+	}
+	reader := array.NewTableReader(table, 2)
+	defer reader.Release()
+	reader.Next()
+	if !reader.Record().Column(1).IsNull(1) {
+		t.Error("expected the second name to be null")
+	}
+	at := table.Column(4).Data().Chunk(0).(*array.Timestamp)
+	if at.Value(0) != arrow.Timestamp(1672628645678) {
+		t.Errorf("expected the timestamp to be 2023-01-02 03:04:05.678 but was %v", at.Value(0))
+	}
+}
+
+func TestExportFailureLeavesNoFile(t *testing.T) {
+	e := newExporter(t, export.FormatCSV, &fakeReader{pages: pages()[:1], err: errors.New("connection reset")})
+	statement := parser.Statement{SQL: "SELECT * FROM t;"}
+	if _, err := e.Export(context.Background(), statement, "job1"); err == nil {
+		t.Fatal("expected an error")
+	}
+	if written, err := e.Written(statement); err != nil || written {
+		t.Errorf("expected the results not to be written but was %v with error %v", written, err)
+	}
+	entries, err := os.ReadDir(filepath.Dir(e.Path(statement)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected no files to be left but had %v", entries)
+	}
+}
@@ -0,0 +1,176 @@
+//	Copyright 2023 Dremio Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apache/arrow/go/v17/arrow"
+	"github.com/apache/arrow/go/v17/arrow/array"
+	"github.com/apache/arrow/go/v17/arrow/memory"
+	"github.com/apache/arrow/go/v17/parquet"
+	"github.com/apache/arrow/go/v17/parquet/compress"
+	"github.com/apache/arrow/go/v17/parquet/pqarrow"
+
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/protocol"
+)
+
+// arrowType maps a Dremio type to the Arrow type of the Parquet column. Decimals keep their precision
+// as strings, and types without a simple equivalent such as lists and structs are written as JSON strings
+func arrowType(dremioType string) arrow.DataType {
+	switch strings.ToUpper(dremioType) {
+	case "BOOLEAN":
+		return arrow.FixedWidthTypes.Boolean
+	case "INTEGER", "INT":
+		return arrow.PrimitiveTypes.Int32
+	case "BIGINT":
+		return arrow.PrimitiveTypes.Int64
+	case "FLOAT":
+		return arrow.PrimitiveTypes.Float32
+	case "DOUBLE":
+		return arrow.PrimitiveTypes.Float64
+	case "DATE":
+		return arrow.FixedWidthTypes.Date32
+	case "TIMESTAMP":
+		return arrow.FixedWidthTypes.Timestamp_ms
+	}
+	return arrow.BinaryTypes.String
+}
+
+// timestampLayouts are the ways a timestamp may be formatted in the results
+var timestampLayouts = []string{
+	"2006-01-02 15:04:05.999999999",
+	time.RFC3339Nano,
+}
+
+type parquetWriter struct {
+	w       *pqarrow.FileWriter
+	schema  []protocol.Column
+	builder *array.RecordBuilder
+}
+
+func newParquetWriter(w io.Writer, schema []protocol.Column) (*parquetWriter, error) {
+	fields := make([]arrow.Field, len(schema))
+	for i, col := range schema {
+		fields[i] = arrow.Field{Name: col.Name, Type: arrowType(col.Type), Nullable: true}
+	}
+	arrowSchema := arrow.NewSchema(fields, nil)
+	props := parquet.NewWriterProperties(parquet.WithCompression(compress.Codecs.Snappy))
+	fw, err := pqarrow.NewFileWriter(arrowSchema, w, props, pqarrow.DefaultWriterProps())
+	if err != nil {
+		return nil, err
+	}
+	return &parquetWriter{
+		w:       fw,
+		schema:  schema,
+		builder: array.NewRecordBuilder(memory.DefaultAllocator, arrowSchema),
+	}, nil
+}
+
+// Write appends the page to the current row group, a new row group is started once it holds
+// the MaxRowGroupLength of the writer properties so small pages do not each become a row group
+func (p *parquetWriter) Write(rows []map[string]json.RawMessage) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	for _, row := range rows {
+		for i, col := range p.schema {
+			if err := appendValue(p.builder.Field(i), row[col.Name]); err != nil {
+				return fmt.Errorf("invalid value for column %v: %w", col.Name, err)
+			}
+		}
+	}
+	record := p.builder.NewRecord()
+	defer record.Release()
+	return p.w.WriteBuffered(record)
+}
+
+func (p *parquetWriter) Close() error {
+	p.builder.Release()
+	return p.w.Close()
+}
+
+// appendValue converts the JSON value to the type of the builder
+func appendValue(b array.Builder, raw json.RawMessage) error {
+	if isNull(raw) {
+		b.AppendNull()
+		return nil
+	}
+	switch b := b.(type) {
+	case *array.BooleanBuilder:
+		v, err := strconv.ParseBool(text(raw))
+		if err != nil {
+			return err
+		}
+		b.Append(v)
+	case *array.Int32Builder:
+		v, err := strconv.ParseInt(text(raw), 10, 32)
+		if err != nil {
+			return err
+		}
+		b.Append(int32(v))
+	case *array.Int64Builder:
+		v, err := strconv.ParseInt(text(raw), 10, 64)
+		if err != nil {
+			return err
+		}
+		b.Append(v)
+	case *array.Float32Builder:
+		v, err := strconv.ParseFloat(text(raw), 32)
+		if err != nil {
+			return err
+		}
+		b.Append(float32(v))
+	case *array.Float64Builder:
+		v, err := strconv.ParseFloat(text(raw), 64)
+		if err != nil {
+			return err
+		}
+		b.Append(v)
+	case *array.Date32Builder:
+		t, err := time.Parse(time.DateOnly, text(raw))
+		if err != nil {
+			return err
+		}
+		b.Append(arrow.Date32FromTime(t))
+	case *array.TimestampBuilder:
+		t, err := parseTimestamp(text(raw))
+		if err != nil {
+			return err
+		}
+		b.Append(arrow.Timestamp(t.UnixMilli()))
+	case *array.StringBuilder:
+		b.Append(text(raw))
+	default:
+		return fmt.Errorf("unsupported column type %v", b.Type())
+	}
+	return nil
+}
+
+func parseTimestamp(s string) (time.Time, error) {
+	var err error
+	for _, layout := range timestampLayouts {
+		var t time.Time
+		if t, err = time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
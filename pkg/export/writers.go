@@ -0,0 +1,135 @@
+//	Copyright 2023 Dremio Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/protocol"
+)
+
+// rowWriter writes pages of rows to a file in one of the formats
+type rowWriter interface {
+	Write(rows []map[string]json.RawMessage) error
+	Close() error
+}
+
+func newRowWriter(format Format, w io.Writer, schema []protocol.Column) (rowWriter, error) {
+	switch format {
+	case FormatCSV:
+		return newCSVWriter(w, schema)
+	case FormatJSONL:
+		return &jsonlWriter{w: bufio.NewWriter(w), schema: schema}, nil
+	case FormatParquet:
+		return newParquetWriter(w, schema)
+	}
+	return nil, fmt.Errorf("unsupported results format '%v'", format)
+}
+
+// isNull is true for values that are null or missing from the row
+func isNull(raw json.RawMessage) bool {
+	return len(raw) == 0 || bytes.Equal(raw, []byte("null"))
+}
+
+// text is the value as plain text, strings without their quotes and anything else as its JSON
+func text(raw json.RawMessage) string {
+	if isNull(raw) {
+		return ""
+	}
+	var s string
+	if raw[0] == '"' && json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	return string(raw)
+}
+
+type csvWriter struct {
+	w      *csv.Writer
+	schema []protocol.Column
+	record []string
+}
+
+func newCSVWriter(w io.Writer, schema []protocol.Column) (*csvWriter, error) {
+	c := &csvWriter{
+		w:      csv.NewWriter(w),
+		schema: schema,
+		record: make([]string, len(schema)),
+	}
+	for i, col := range schema {
+		c.record[i] = col.Name
+	}
+	if err := c.w.Write(c.record); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *csvWriter) Write(rows []map[string]json.RawMessage) error {
+	for _, row := range rows {
+		for i, col := range c.schema {
+			c.record[i] = text(row[col.Name])
+		}
+		if err := c.w.Write(c.record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *csvWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// jsonlWriter writes the columns of each row in the order of the schema, missing values are null
+type jsonlWriter struct {
+	w      *bufio.Writer
+	schema []protocol.Column
+}
+
+func (j *jsonlWriter) Write(rows []map[string]json.RawMessage) error {
+	for _, row := range rows {
+		j.w.WriteByte('{')
+		for i, col := range j.schema {
+			if i > 0 {
+				j.w.WriteByte(',')
+			}
+			name, err := json.Marshal(col.Name)
+			if err != nil {
+				return err
+			}
+			j.w.Write(name)
+			j.w.WriteByte(':')
+			value := row[col.Name]
+			if isNull(value) {
+				value = json.RawMessage("null")
+			}
+			j.w.Write(value)
+		}
+		if _, err := j.w.WriteString("}\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (j *jsonlWriter) Close() error {
+	return j.w.Flush()
+}
@@ -7,21 +7,26 @@ import (
 	"strings"
 
 	"github.com/rsvihladremio/dremio-batch-execute/pkg/conf"
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/progress"
 )
 
 var Version = "dev"
 var GitSha = "unknown"
 
 type QueryResults struct {
-	Completed int
-	Total     int
-	Failed    int
+	Completed         int
+	Total             int
+	Failed            int
+	Reauthentications int // Reauthentications is how many times the session with Dremio expired and was renewed
 }
 
 func LogQueriesCompleted(q QueryResults) {
 	percentFailed := (float64(q.Failed) / float64(q.Total)) * 100.0
 	completedString := fmt.Sprintf("%v/%v", q.Completed+q.Failed, q.Total)
 	log.Printf("%*v - failure rate (%04.1f%%)", len(completedString)+2, completedString, percentFailed)
+	if q.Reauthentications > 0 {
+		log.Printf("logged in again %v time(s) after the session expired", q.Reauthentications)
+	}
 }
 
 func LogStartMessage(args conf.Args) error {
@@ -38,17 +43,105 @@ func LogStartMessage(args conf.Args) error {
 		return err
 	}
 	log.Printf("progress file:   %v", fullProgressPath)
-	log.Printf("url:             %v", args.DremioURL)
-	log.Printf("user:            %v", args.DremioUsername)
-	masked, err := MaskString(args.DremioPassword)
+	// an existing progress file keeps the format it was written in
+	progressFormat, existing, err := progress.DetectFormat(args.ProgressFilePath)
 	if err != nil {
 		return err
 	}
-	log.Printf("pass:            %v", masked)
-	log.Printf("timeout:         %v", args.HTTPTimeout)
+	if existing {
+		log.Printf("progress format: %v (from the existing progress file)", progressFormat)
+	} else {
+		log.Printf("progress format: %v", args.ProgressFormat)
+	}
+	log.Printf("hash only:       %v", args.ProgressHashOnly)
+	log.Printf("fsync every:     %v records, %v", args.ProgressSyncEvery, args.ProgressSyncInterval)
+	if args.FailedFilePath != "" {
+		fullFailedPath, err := filepath.Abs(args.FailedFilePath)
+		if err != nil {
+			return err
+		}
+		log.Printf("failed file:     %v", fullFailedPath)
+	}
+	if args.ResultsDir != "" {
+		fullResultsPath, err := filepath.Abs(args.ResultsDir)
+		if err != nil {
+			return err
+		}
+		log.Printf("results dir:     %v (%v)", fullResultsPath, args.ResultsFormat)
+	}
+	if args.Protocol != "" {
+		log.Printf("protocol:        %v", args.Protocol)
+	}
+	switch {
+	case args.Protocol == "sql":
+		// the dsn is not logged as it may contain a password
+		log.Printf("sql driver:      %v", args.SQLDriver)
+	case args.CloudProjectID != "":
+		log.Printf("cloud project:   %v", args.CloudProjectID)
+		log.Printf("cloud region:    %v", args.CloudRegion)
+	default:
+		log.Printf("url:             %v", args.DremioURL)
+	}
+	if args.CloudProjectID != "" || strings.HasPrefix(args.DremioURL, "https") || strings.HasPrefix(args.DremioURL, "grpc+tls") {
+		log.Printf("skip ssl verify: %v", args.SkipSSL)
+		if args.CACertFile != "" {
+			log.Printf("ca cert:         %v", args.CACertFile)
+		}
+		if args.ClientCertFile != "" {
+			log.Printf("client cert:     %v", args.ClientCertFile)
+		}
+		if args.TLSMinVersion != "" {
+			log.Printf("tls min version: %v", args.TLSMinVersion)
+		}
+		if args.TLSServerName != "" {
+			log.Printf("tls server name: %v", args.TLSServerName)
+		}
+	}
+	if args.Protocol != "sql" {
+		switch args.Auth {
+		case "", "password":
+			log.Printf("auth:            password")
+			log.Printf("user:            %v", args.DremioUsername)
+			masked, err := MaskString(args.DremioPassword)
+			if err != nil {
+				return err
+			}
+			log.Printf("pass:            %v", masked)
+		default:
+			log.Printf("auth:            %v", args.Auth)
+			if args.TokenFile != "" {
+				log.Printf("token file:      %v", args.TokenFile)
+			} else {
+				log.Printf("token env:       %v", args.TokenEnv)
+			}
+		}
+	}
+	if args.QueryContext != "" {
+		log.Printf("context:         %v", args.QueryContext)
+	}
+	if args.References != "" {
+		log.Printf("references:      %v", args.References)
+	}
+	log.Printf("timeout:         %v, cancel wait %v, http request %v", args.HTTPTimeout, args.CancelTimeout, args.HTTPRequestTimeout)
+	log.Printf("poll interval:   %v up to %v", args.PollInterval, args.MaxPollInterval)
 	log.Printf("request sleep:   %v", args.RequestSleepTime)
+	switch {
+	case args.MaxQPS > 0:
+		log.Printf("rate limit:      %v/s burst %v", args.MaxQPS, args.MaxBurst)
+	case args.MaxQueriesPerMinute > 0:
+		log.Printf("rate limit:      %v/min burst %v", args.MaxQueriesPerMinute, args.MaxBurst)
+	default:
+		log.Printf("rate limit:      none")
+	}
+	log.Printf("max attempts:    %v, backoff %v up to %v", args.MaxAttempts, args.RetryBackoff, args.RetryMaxBackoff)
+	log.Printf("grace period:    %v", args.ShutdownGracePeriod)
 	log.Printf("batch size:      %v", args.BatchSize)
 	log.Printf("request threads: %v", args.RequestThreads)
+	if args.Adaptive {
+		log.Printf("adaptive:        %v-%v threads, target latency %v, max error rate %.1f%%, every %v",
+			args.MinThreads, args.MaxThreads, args.TargetLatency, args.MaxErrorRate*100, args.AdjustInterval)
+	}
+	log.Printf("unterminated:    %v", args.AllowUnterminated)
 	return nil
 }
 
@@ -0,0 +1,251 @@
+//	Copyright 2023 Dremio Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// names of the annotations the tool understands
+const (
+	AnnotationLabel      = "label"      // AnnotationLabel names a statement, for example in the file its results are exported to
+	AnnotationContext    = "context"    // AnnotationContext is the path the statement runs in, such as space.folder
+	AnnotationReferences = "references" // AnnotationReferences are the versions of sources the statement runs against
+)
+
+// defaultPrefix marks an annotation that applies to every later statement of the file as well, so
+// "-- @default-context: space.folder" sets the context of that statement and of the ones after it that
+// do not have a context of their own
+const defaultPrefix = "default-"
+
+// valueAnnotations only make sense with a value, they are left blank rather than "true" when it is missing
+// so that checkAnnotations rejects them
+var valueAnnotations = map[string]bool{
+	AnnotationLabel:      true,
+	AnnotationContext:    true,
+	AnnotationReferences: true,
+}
+
+// Annotations reads the "-- @name value" comments on the lines before a statement, a ':' after the name
+// is optional so "-- @label: daily_sales" and "-- @label daily_sales" are the same. Names are lower case,
+// a name without a value is "true", except for the ones that need a value which are blank, and comments after
+// the statement starts are not annotations
+func Annotations(sql string) map[string]string {
+	var annotations map[string]string
+	for _, line := range strings.Split(sql, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "--") {
+			break
+		}
+		comment := strings.TrimSpace(strings.TrimPrefix(line, "--"))
+		if !strings.HasPrefix(comment, "@") {
+			continue
+		}
+		name, value, _ := strings.Cut(comment[1:], " ")
+		name = strings.ToLower(strings.TrimSuffix(name, ":"))
+		if name == "" {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if value == "" && !valueAnnotations[strings.TrimPrefix(name, defaultPrefix)] {
+			value = "true"
+		}
+		if annotations == nil {
+			annotations = make(map[string]string)
+		}
+		annotations[name] = value
+	}
+	return annotations
+}
+
+// checkAnnotations rejects the annotations of a statement that are missing their value, and contexts and
+// references that cannot be parsed, including the defaults it sets
+func checkAnnotations(annotations map[string]string) error {
+	for name, value := range annotations {
+		base := strings.TrimPrefix(name, defaultPrefix)
+		if valueAnnotations[base] && value == "" {
+			return fmt.Errorf("the annotation @%v needs a value", name)
+		}
+		var err error
+		switch base {
+		case AnnotationContext:
+			_, err = ParseContext(value)
+		case AnnotationReferences:
+			_, err = ParseReferences(value)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid annotation @%v: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// withDefaults returns the annotations of a statement with the defaults of the file applied, and records any
+// defaults the statement sets for the statements after it
+func withDefaults(defaults, annotations map[string]string) map[string]string {
+	for name, value := range annotations {
+		if strings.HasPrefix(name, defaultPrefix) {
+			defaults[strings.TrimPrefix(name, defaultPrefix)] = value
+		}
+	}
+	if len(defaults) == 0 {
+		return annotations
+	}
+	merged := make(map[string]string, len(defaults)+len(annotations))
+	for name, value := range defaults {
+		merged[name] = value
+	}
+	for name, value := range annotations {
+		if !strings.HasPrefix(name, defaultPrefix) {
+			merged[name] = value
+		}
+	}
+	return merged
+}
+
+// Reference is a branch, tag or commit of a versioned source
+type Reference struct {
+	Type  string // Type is BRANCH, TAG or COMMIT
+	Value string
+}
+
+// referenceTypes are the kinds of reference Dremio accepts
+var referenceTypes = map[string]bool{
+	"BRANCH": true,
+	"TAG":    true,
+	"COMMIT": true,
+}
+
+// ParseContext reads a dotted path such as space.folder, a part with a '.' in it is double quoted as in
+// space."folder.2023" and a '"' inside the quotes is doubled
+func ParseContext(path string) ([]string, error) {
+	path = strings.TrimSpace(path)
+	if path == "" {
+		return nil, nil
+	}
+	var parts []string
+	var part strings.Builder
+	quoted := false
+	wasQuoted := false
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case quoted && c == '"' && i+1 < len(path) && path[i+1] == '"':
+			part.WriteByte('"')
+			i++
+		case c == '"' && (quoted || part.Len() == 0 && !wasQuoted):
+			quoted = !quoted
+			wasQuoted = true
+		case wasQuoted && !quoted && c != '.':
+			return nil, fmt.Errorf("invalid context '%v', a quoted part must end at its closing quote", path)
+		case !quoted && c == '.':
+			if part.Len() == 0 && !wasQuoted {
+				return nil, fmt.Errorf("invalid context '%v', it has an empty part", path)
+			}
+			parts = append(parts, part.String())
+			part.Reset()
+			wasQuoted = false
+		default:
+			part.WriteByte(c)
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("invalid context '%v', a quote is not closed", path)
+	}
+	if part.Len() == 0 && !wasQuoted {
+		return nil, fmt.Errorf("invalid context '%v', it has an empty part", path)
+	}
+	return append(parts, part.String()), nil
+}
+
+// ParseReferences reads a comma separated list of source=type:value, such as "lake=branch:dev, arctic=tag:v1".
+// The type is branch, tag or commit, and when it is left out as in "lake=dev" the value is a branch
+func ParseReferences(list string) (map[string]Reference, error) {
+	var references map[string]Reference
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		source, version, ok := strings.Cut(item, "=")
+		source = strings.TrimSpace(source)
+		version = strings.TrimSpace(version)
+		if !ok || source == "" || version == "" {
+			return nil, fmt.Errorf("invalid reference '%v', use source=branch:name, source=tag:name or source=commit:hash", item)
+		}
+		ref := Reference{Type: "BRANCH", Value: version}
+		if refType, value, ok := strings.Cut(version, ":"); ok {
+			ref = Reference{Type: strings.ToUpper(strings.TrimSpace(refType)), Value: strings.TrimSpace(value)}
+		}
+		if !referenceTypes[ref.Type] || ref.Value == "" {
+			return nil, fmt.Errorf("invalid reference '%v', use source=branch:name, source=tag:name or source=commit:hash", item)
+		}
+		if references == nil {
+			references = make(map[string]Reference)
+		}
+		references[source] = ref
+	}
+	return references, nil
+}
+
+// rowKeywords start the statements that return rows
+var rowKeywords = map[string]bool{
+	"SELECT":   true,
+	"WITH":     true,
+	"VALUES":   true,
+	"TABLE":    true,
+	"SHOW":     true,
+	"DESCRIBE": true,
+	"DESC":     true,
+	"EXPLAIN":  true,
+}
+
+// ReturnsRows is true for statements such as SELECT that return rows rather than changing anything
+func ReturnsRows(sql string) bool {
+	return rowKeywords[strings.ToUpper(firstKeyword(sql))]
+}
+
+// firstKeyword is the first word of the statement after any comments and opening parentheses
+func firstKeyword(sql string) string {
+	s := sql
+	for {
+		s = strings.TrimLeftFunc(s, func(r rune) bool { return unicode.IsSpace(r) || r == '(' })
+		switch {
+		case strings.HasPrefix(s, "--"):
+			_, rest, found := strings.Cut(s, "\n")
+			if !found {
+				return ""
+			}
+			s = rest
+		case strings.HasPrefix(s, "/*"):
+			_, rest, found := strings.Cut(s[2:], "*/")
+			if !found {
+				return ""
+			}
+			s = rest
+		default:
+			end := strings.IndexFunc(s, func(r rune) bool { return !isIdentifierRune(r) })
+			if end < 0 {
+				return s
+			}
+			return s[:end]
+		}
+	}
+}
@@ -15,8 +15,9 @@
 package parser
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 
@@ -24,91 +25,181 @@ import (
 )
 
 // ReadQueries reads the query file and extracts sql queries from it, each query must end with a ';'
-func ReadQueries(sourceQueryFile string) (queries []string, err error) {
+// unless allowUnterminated is set, in which case the last query in the file may omit it.
+// See Scanner for the rules used to find the end of a statement
+func ReadQueries(sourceQueryFile string, allowUnterminated bool) (queries []string, err error) {
 	f, err := os.Open(sourceQueryFile)
 	if err != nil {
 		return []string{}, err
 	}
-	scanner := bufio.NewScanner(f)
-
-	// adjust the capacity to your need (max characters in line)
-	const maxLineLength = 1024 * 1024
-	buf := make([]byte, maxLineLength)
-	scanner.Buffer(buf, maxLineLength)
-	var existingSql strings.Builder
+	defer f.Close()
+	scanner := NewScanner(f)
+	scanner.AllowUnterminated = allowUnterminated
 	for scanner.Scan() {
-		line := scanner.Text()
-		if _, err := existingSql.WriteString(line); err != nil {
-			return []string{}, err
-		}
-		if strings.HasSuffix(line, ";") {
-			//statement now complete
-			queries = append(queries, existingSql.String())
-			existingSql.Reset()
-		} else {
-			if _, err := existingSql.WriteString("\n"); err != nil {
-				return []string{}, err
-			}
+		queries = append(queries, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		var unterminated *UnterminatedStatementError
+		if errors.As(err, &unterminated) {
+			unterminated.File = sourceQueryFile
 		}
+		return []string{}, err
 	}
 	return
 }
 
-func GroupStatements(queries []string, batchSize int) ([]string, error) {
-	var batched []string
-	var currentBatch strings.Builder
-	for i, q := range queries {
-		if _, err := currentBatch.WriteString(q); err != nil {
-			return []string{}, err
-		}
-		if _, err := currentBatch.WriteString("\n"); err != nil {
-			return []string{}, err
-		}
-		if i%batchSize == 0 {
-			batched = append(batched, currentBatch.String())
-			currentBatch.Reset()
-		}
-	}
-	if currentBatch.Len() > 0 {
-		batched = append(batched, currentBatch.String())
-		currentBatch.Reset()
-	}
-	return batched, nil
+// Statement is a query read from a source file
+type Statement struct {
+	SQL  string // SQL text of the query including the terminating ';'
+	File string // File the query was read from
+	Line int    // Line the query starts on
+	// Annotations are read from the comments before the query, see Annotations, with the defaults set by
+	// earlier queries of the file applied
+	Annotations map[string]string
+}
+
+// Completed reports the queries that have already been executed
+type Completed interface {
+	Contains(query string) bool
+}
+
+// QuerySource lazily reads the queries of a source file one at a time so that memory use does not grow
+// with the size of the file. Queries that are already completed are skipped.
+type QuerySource struct {
+	args      conf.Args
+	f         *os.File
+	scanner   *Scanner
+	completed Completed
+	total     int
+	defaults  map[string]string
 }
 
-func ReadQueriesWithProgressFileFiltering(args conf.Args) (queries []string, err error) {
-	queriesInSourceFile, err := ReadQueries(args.SourceQueryFile)
+// NewQuerySource opens the source file and makes a first pass over it to validate every query and count
+// the ones left to run, the file is then read again as queries are requested with Next
+func NewQuerySource(args conf.Args, completed Completed) (*QuerySource, error) {
+	f, err := os.Open(args.SourceQueryFile)
 	if err != nil {
-		return
+		return nil, err
 	}
-	var completedQueries []string
-	if _, statErr := os.Stat(args.ProgressFilePath); statErr == nil {
-		completedQueries, err = ReadQueries(args.ProgressFilePath)
-		if err != nil {
-			return
-		}
+	q := &QuerySource{
+		args:      args,
+		f:         f,
+		completed: completed,
+		defaults:  make(map[string]string),
 	}
-	for _, proposedQuery := range queriesInSourceFile {
-		skipQuery := false
-		for _, completedQuery := range completedQueries {
-			// if we find a completed query has already been done then don't add this query
-			if proposedQuery == completedQuery {
-				skipQuery = true
-				break
+	queriesInSourceFile := 0
+	remaining := 0
+	// labels name the results files of the statements so each one is only used once, including the ones
+	// set by a default-label annotation
+	labels := make(map[string]int)
+	defaults := make(map[string]string)
+	q.scanner = q.newScanner()
+	for q.scanner.Scan() {
+		queriesInSourceFile++
+		line := q.scanner.Line()
+		annotations := Annotations(q.scanner.Text())
+		if err := checkAnnotations(annotations); err != nil {
+			q.Close()
+			return nil, fmt.Errorf("%v:%v: %w", args.SourceQueryFile, line, err)
+		}
+		if comment := q.scanner.TrailingComment(); len(Annotations(comment)) > 0 {
+			// it would otherwise be silently ignored, annotations only apply to the statement after them
+			q.Close()
+			return nil, fmt.Errorf("%v:%v: the annotation %q follows the statement on the same line, put it on a line before the statement it applies to", args.SourceQueryFile, line, comment)
+		}
+		if label := withDefaults(defaults, annotations)[AnnotationLabel]; label != "" {
+			if first, ok := labels[label]; ok {
+				q.Close()
+				return nil, fmt.Errorf("%v:%v: the label '%v' is already used by the statement on line %v, each label must be unique", args.SourceQueryFile, line, label, first)
 			}
+			labels[label] = line
 		}
-		if !skipQuery {
-			queries = append(queries, proposedQuery)
+		if !q.completed.Contains(q.scanner.Text()) {
+			remaining++
 		}
 	}
-	if len(queriesInSourceFile) > 0 && len(queries) == 0 {
-		err = fmt.Errorf("all queries in file %v have already been completed according to the file %v. If this is undesirable delete the file %v and try again", args.SourceQueryFile, args.ProgressFilePath, args.ProgressFilePath)
+	if err := q.scannerErr(); err != nil {
+		q.Close()
+		return nil, err
+	}
+	if queriesInSourceFile > 0 && remaining == 0 {
+		q.Close()
+		return nil, fmt.Errorf("all queries in file %v have already been completed according to the file %v. If this is undesirable delete the file %v and try again", args.SourceQueryFile, args.ProgressFilePath, args.ProgressFilePath)
 	}
+	q.total = remaining
 	if args.BatchSize > 1 {
-		queries, err = GroupStatements(queries, args.BatchSize)
-		if err != nil {
-			return
+		q.total = (remaining + args.BatchSize - 1) / args.BatchSize
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		q.Close()
+		return nil, err
+	}
+	q.scanner = q.newScanner()
+	return q, nil
+}
+
+// Total is the number of queries Next will return
+func (q *QuerySource) Total() int {
+	return q.total
+}
+
+// Next returns the next query that has not been completed yet, io.EOF is returned once there are no more.
+// When a batch size above 1 is configured queries are grouped, one per line
+func (q *QuerySource) Next() (Statement, error) {
+	batchSize := q.args.BatchSize
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	var batch strings.Builder
+	count := 0
+	line := 0
+	var annotations map[string]string
+	for count < batchSize && q.scanner.Scan() {
+		query := q.scanner.Text()
+		// defaults set by completed statements still apply to the ones after them
+		queryAnnotations := withDefaults(q.defaults, Annotations(query))
+		if q.completed.Contains(query) {
+			continue
 		}
+		if count > 0 {
+			batch.WriteString("\n")
+		} else {
+			line = q.scanner.Line()
+			annotations = queryAnnotations
+		}
+		batch.WriteString(query)
+		count++
 	}
-	return
+	if err := q.scannerErr(); err != nil {
+		return Statement{}, err
+	}
+	if count == 0 {
+		return Statement{}, io.EOF
+	}
+	return Statement{
+		SQL:         batch.String(),
+		File:        q.args.SourceQueryFile,
+		Line:        line,
+		Annotations: annotations,
+	}, nil
+}
+
+// Close releases the source file
+func (q *QuerySource) Close() error {
+	return q.f.Close()
+}
+
+func (q *QuerySource) newScanner() *Scanner {
+	scanner := NewScanner(q.f)
+	scanner.AllowUnterminated = q.args.AllowUnterminated
+	return scanner
+}
+
+func (q *QuerySource) scannerErr() error {
+	err := q.scanner.Err()
+	var unterminated *UnterminatedStatementError
+	if errors.As(err, &unterminated) {
+		unterminated.File = q.args.SourceQueryFile
+	}
+	return err
 }
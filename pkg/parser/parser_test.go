@@ -0,0 +1,544 @@
+//	Copyright 2023 Dremio Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser_test
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/conf"
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/parser"
+)
+
+func scanAll(t *testing.T, sql string) []string {
+	t.Helper()
+	scanner := parser.NewScanner(strings.NewReader(sql))
+	statements := []string{}
+	for scanner.Scan() {
+		statements = append(statements, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("unexpected %v", err)
+	}
+	return statements
+}
+
+func TestScannerSplitsStatements(t *testing.T) {
+	tests := []struct {
+		name     string
+		sql      string
+		expected []string
+	}{
+		{
+			name:     "one per line",
+			sql:      "INSERT INTO a.b VALUES(1, 2);\nINSERT INTO a.b VALUES(1, 3);\n",
+			expected: []string{"INSERT INTO a.b VALUES(1, 2);", "INSERT INTO a.b VALUES(1, 3);"},
+		},
+		{
+			name:     "multiple lines",
+			sql:      "INSERT INTO \n    a.b \nVALUES(1, 4);\n",
+			expected: []string{"INSERT INTO \n    a.b \nVALUES(1, 4);"},
+		},
+		{
+			name:     "same line",
+			sql:      "SELECT 1; SELECT 2;SELECT 3;",
+			expected: []string{"SELECT 1;", "SELECT 2;", "SELECT 3;"},
+		},
+		{
+			name:     "semicolon in string literal",
+			sql:      "INSERT INTO a.b VALUES(';', 'a;b');",
+			expected: []string{"INSERT INTO a.b VALUES(';', 'a;b');"},
+		},
+		{
+			name:     "escaped quote",
+			sql:      "INSERT INTO a.b VALUES('it''s;', 1); SELECT 2;",
+			expected: []string{"INSERT INTO a.b VALUES('it''s;', 1);", "SELECT 2;"},
+		},
+		{
+			name:     "quoted identifiers",
+			sql:      "SELECT \"a;b\", `c;d` FROM t;",
+			expected: []string{"SELECT \"a;b\", `c;d` FROM t;"},
+		},
+		{
+			name:     "line comment",
+			sql:      "SELECT 1 -- not the end;\nFROM t;",
+			expected: []string{"SELECT 1 -- not the end;\nFROM t;"},
+		},
+		{
+			name:     "block comment",
+			sql:      "SELECT /* ; */ 1; /* trailing; */",
+			expected: []string{"SELECT /* ; */ 1;"},
+		},
+		{
+			name:     "dollar quoted",
+			sql:      "SELECT $$a;b$$; SELECT $tag$ $$; $tag$;",
+			expected: []string{"SELECT $$a;b$$;", "SELECT $tag$ $$; $tag$;"},
+		},
+		{
+			name:     "dollar in identifier",
+			sql:      "SELECT a$b, $1 FROM t;",
+			expected: []string{"SELECT a$b, $1 FROM t;"},
+		},
+		{
+			name:     "empty statements",
+			sql:      ";; -- comment\n;SELECT 1;",
+			expected: []string{"SELECT 1;"},
+		},
+		{
+			name:     "windows line endings",
+			sql:      "SELECT 1\r\nFROM t;\r\n",
+			expected: []string{"SELECT 1\nFROM t;"},
+		},
+		{
+			name:     "trailing comment",
+			sql:      "SELECT 1; -- @label x\nSELECT 2;\t-- about 2\r\nSELECT 3; SELECT 4; -- about 4",
+			expected: []string{"SELECT 1; -- @label x", "SELECT 2;\t-- about 2", "SELECT 3;", "SELECT 4; -- about 4"},
+		},
+		{
+			name:     "windows line endings in literals",
+			sql:      "SELECT 'a\r\nb', \"c\r\nd\"\r\nFROM t;",
+			expected: []string{"SELECT 'a\r\nb', \"c\r\nd\"\nFROM t;"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := scanAll(t, tt.sql)
+			if !reflect.DeepEqual(tt.expected, actual) {
+				t.Errorf("expected\n%q\nactual\n%q", tt.expected, actual)
+			}
+		})
+	}
+}
+
+func TestScannerKeepsTrailingComment(t *testing.T) {
+	scanner := parser.NewScanner(strings.NewReader("SELECT 1; -- @label x\nSELECT 2;\n"))
+	expected := []struct {
+		line    int
+		comment string
+	}{
+		{line: 1, comment: "-- @label x"},
+		{line: 2, comment: ""},
+	}
+	for _, e := range expected {
+		if !scanner.Scan() {
+			t.Fatalf("expected a statement but had %v", scanner.Err())
+		}
+		if scanner.Line() != e.line || scanner.TrailingComment() != e.comment {
+			t.Errorf("expected line %v and comment %q for %q but had %v and %q", e.line, e.comment, scanner.Text(), scanner.Line(), scanner.TrailingComment())
+		}
+	}
+}
+
+func TestReadQueries(t *testing.T) {
+	sourceFile := filepath.Join(t.TempDir(), "queries.sql")
+	sql := "INSERT INTO a.b VALUES(';');\nINSERT INTO a.b VALUES(2); INSERT INTO a.b VALUES(3);\n"
+	if err := os.WriteFile(sourceFile, []byte(sql), 0600); err != nil {
+		t.Fatalf("unable to setup test %v", err)
+	}
+	queries, err := parser.ReadQueries(sourceFile, false)
+	if err != nil {
+		t.Fatalf("unexpected %v", err)
+	}
+	expected := []string{
+		"INSERT INTO a.b VALUES(';');",
+		"INSERT INTO a.b VALUES(2);",
+		"INSERT INTO a.b VALUES(3);",
+	}
+	if !reflect.DeepEqual(expected, queries) {
+		t.Errorf("expected\n%q\nactual\n%q", expected, queries)
+	}
+}
+
+func TestReadQueriesRejectsUnterminatedStatement(t *testing.T) {
+	sourceFile := filepath.Join(t.TempDir(), "queries.sql")
+	sql := "INSERT INTO a.b VALUES(1);\n-- last one\nINSERT INTO a.b\nVALUES(2)\n"
+	if err := os.WriteFile(sourceFile, []byte(sql), 0600); err != nil {
+		t.Fatalf("unable to setup test %v", err)
+	}
+	_, err := parser.ReadQueries(sourceFile, false)
+	var unterminated *parser.UnterminatedStatementError
+	if !errors.As(err, &unterminated) {
+		t.Fatalf("expected an UnterminatedStatementError but had %v", err)
+	}
+	if unterminated.File != sourceFile {
+		t.Errorf("expected file %v but had %v", sourceFile, unterminated.File)
+	}
+	if unterminated.Line != 3 {
+		t.Errorf("expected line 3 but had %v", unterminated.Line)
+	}
+
+	queries, err := parser.ReadQueries(sourceFile, true)
+	if err != nil {
+		t.Fatalf("unexpected %v", err)
+	}
+	expected := []string{
+		"INSERT INTO a.b VALUES(1);",
+		"-- last one\nINSERT INTO a.b\nVALUES(2)",
+	}
+	if !reflect.DeepEqual(expected, queries) {
+		t.Errorf("expected\n%q\nactual\n%q", expected, queries)
+	}
+}
+
+func TestReadQueriesIgnoresTrailingComments(t *testing.T) {
+	sourceFile := filepath.Join(t.TempDir(), "queries.sql")
+	sql := "INSERT INTO a.b VALUES(1);\n-- done\n/* really */\n"
+	if err := os.WriteFile(sourceFile, []byte(sql), 0600); err != nil {
+		t.Fatalf("unable to setup test %v", err)
+	}
+	queries, err := parser.ReadQueries(sourceFile, false)
+	if err != nil {
+		t.Fatalf("unexpected %v", err)
+	}
+	if len(queries) != 1 {
+		t.Errorf("expected 1 query but had %q", queries)
+	}
+}
+
+func TestReadQueriesRejectsUnterminatedBlockComment(t *testing.T) {
+	sourceFile := filepath.Join(t.TempDir(), "queries.sql")
+	sql := "INSERT INTO a.b VALUES(1);\n\n/* INSERT INTO a.b VALUES(2);\nINSERT INTO a.b VALUES(3);\n"
+	if err := os.WriteFile(sourceFile, []byte(sql), 0600); err != nil {
+		t.Fatalf("unable to setup test %v", err)
+	}
+	for _, allowUnterminated := range []bool{false, true} {
+		_, err := parser.ReadQueries(sourceFile, allowUnterminated)
+		var unterminated *parser.UnterminatedStatementError
+		if !errors.As(err, &unterminated) {
+			t.Fatalf("expected an UnterminatedStatementError but had %v", err)
+		}
+		if !unterminated.Comment {
+			t.Errorf("expected the error to be for a block comment but had %v", err)
+		}
+		if unterminated.Line != 3 {
+			t.Errorf("expected line 3 but had %v", unterminated.Line)
+		}
+	}
+}
+
+func TestUnterminatedStatementErrorTruncatesOnRuneBoundary(t *testing.T) {
+	err := &parser.UnterminatedStatementError{Line: 1, Statement: "SELECT " + strings.Repeat("é", 80)}
+	message := err.Error()
+	if !utf8.ValidString(message) {
+		t.Errorf("expected valid UTF-8 but had %q", message)
+	}
+	if !strings.Contains(message, "...") {
+		t.Errorf("expected the statement to be truncated but had %q", message)
+	}
+}
+
+type completedSet map[string]bool
+
+func (c completedSet) Contains(query string) bool {
+	return c[query]
+}
+
+func TestQuerySourceSkipsCompletedQueries(t *testing.T) {
+	sourceFile := filepath.Join(t.TempDir(), "queries.sql")
+	if err := os.WriteFile(sourceFile, []byte("SELECT 1;\nSELECT 2;\nSELECT 3;\n"), 0600); err != nil {
+		t.Fatalf("unable to setup test %v", err)
+	}
+	source, err := parser.NewQuerySource(conf.Args{
+		SourceQueryFile: sourceFile,
+	}, completedSet{"SELECT 2;": true})
+	if err != nil {
+		t.Fatalf("unexpected %v", err)
+	}
+	defer source.Close()
+	if source.Total() != 2 {
+		t.Errorf("expected 2 queries but had %v", source.Total())
+	}
+	queries := []string{}
+	for {
+		q, err := source.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected %v", err)
+		}
+		queries = append(queries, q.SQL)
+		if q.File != sourceFile {
+			t.Errorf("expected file %v but had %v", sourceFile, q.File)
+		}
+	}
+	expected := []string{"SELECT 1;", "SELECT 3;"}
+	if !reflect.DeepEqual(expected, queries) {
+		t.Errorf("expected\n%q\nactual\n%q", expected, queries)
+	}
+}
+
+func TestQuerySourceAllCompleted(t *testing.T) {
+	sourceFile := filepath.Join(t.TempDir(), "queries.sql")
+	if err := os.WriteFile(sourceFile, []byte("SELECT 1;\n"), 0600); err != nil {
+		t.Fatalf("unable to setup test %v", err)
+	}
+	if _, err := parser.NewQuerySource(conf.Args{
+		SourceQueryFile: sourceFile,
+	}, completedSet{"SELECT 1;": true}); err == nil {
+		t.Fatal("expected an error when every query is already complete")
+	}
+}
+
+func TestAnnotations(t *testing.T) {
+	tests := []struct {
+		name     string
+		sql      string
+		expected map[string]string
+	}{
+		{name: "none", sql: "SELECT 1;"},
+		{name: "plain comment", sql: "-- daily sales\nSELECT 1;"},
+		{name: "label", sql: "-- @label: daily_sales\nSELECT 1;", expected: map[string]string{"label": "daily_sales"}},
+		{name: "without colon", sql: "-- @Label daily_sales\nSELECT 1;", expected: map[string]string{"label": "daily_sales"}},
+		{name: "flag", sql: "-- @skip\nSELECT 1;", expected: map[string]string{"skip": "true"}},
+		{name: "missing value", sql: "-- @context\n-- @default-label:\nSELECT 1;", expected: map[string]string{"context": "", "default-label": ""}},
+		{name: "several", sql: "-- @label: a\n-- about the query\n\n--@other b c\nSELECT 1;", expected: map[string]string{"label": "a", "other": "b c"}},
+		{name: "after the statement starts", sql: "SELECT 1\n-- @label: a\n;", expected: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if actual := parser.Annotations(tt.sql); !reflect.DeepEqual(tt.expected, actual) {
+				t.Errorf("expected %v but had %v", tt.expected, actual)
+			}
+		})
+	}
+}
+
+func TestParseContext(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected []string
+		err      bool
+	}{
+		{path: "", expected: nil},
+		{path: "sales", expected: []string{"sales"}},
+		{path: " sales.reporting ", expected: []string{"sales", "reporting"}},
+		{path: `lake."folder.2023".t`, expected: []string{"lake", "folder.2023", "t"}},
+		{path: `"say ""hi"""`, expected: []string{`say "hi"`}},
+		{path: "sales..reporting", err: true},
+		{path: "sales.", err: true},
+		{path: `"sales`, err: true},
+		{path: `"a"b`, err: true},
+		{path: `"a" .b`, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			actual, err := parser.ParseContext(tt.path)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected an error but had %q", actual)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(tt.expected, actual) {
+				t.Errorf("expected %q but had %q", tt.expected, actual)
+			}
+		})
+	}
+}
+
+func TestParseReferences(t *testing.T) {
+	tests := []struct {
+		list     string
+		expected map[string]parser.Reference
+		err      bool
+	}{
+		{list: "", expected: nil},
+		{list: "lake=dev", expected: map[string]parser.Reference{"lake": {Type: "BRANCH", Value: "dev"}}},
+		{list: "lake=branch:dev, arctic=TAG:v1.0,nessie=commit:8f2a", expected: map[string]parser.Reference{
+			"lake":   {Type: "BRANCH", Value: "dev"},
+			"arctic": {Type: "TAG", Value: "v1.0"},
+			"nessie": {Type: "COMMIT", Value: "8f2a"},
+		}},
+		{list: "lake", err: true},
+		{list: "lake=", err: true},
+		{list: "lake=snapshot:1", err: true},
+		{list: "lake=tag:", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.list, func(t *testing.T) {
+			actual, err := parser.ParseReferences(tt.list)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected an error but had %v", actual)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(tt.expected, actual) {
+				t.Errorf("expected %v but had %v", tt.expected, actual)
+			}
+		})
+	}
+}
+
+func TestReturnsRows(t *testing.T) {
+	tests := []struct {
+		sql      string
+		expected bool
+	}{
+		{sql: "SELECT 1;", expected: true},
+		{sql: "-- @label: a\n/* totals */ (select 1) UNION (select 2);", expected: true},
+		{sql: "WITH a AS (SELECT 1) SELECT * FROM a;", expected: true},
+		{sql: "SHOW TABLES;", expected: true},
+		{sql: "INSERT INTO t SELECT 1;", expected: false},
+		{sql: "CREATE TABLE t AS SELECT 1;", expected: false},
+		{sql: "-- SELECT\nDROP TABLE t;", expected: false},
+		{sql: "SELECTED;", expected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sql, func(t *testing.T) {
+			if actual := parser.ReturnsRows(tt.sql); actual != tt.expected {
+				t.Errorf("expected %v but had %v", tt.expected, actual)
+			}
+		})
+	}
+}
+
+func TestQuerySourceReadsAnnotations(t *testing.T) {
+	sourceFile := filepath.Join(t.TempDir(), "queries.sql")
+	if err := os.WriteFile(sourceFile, []byte("-- @label: first\nSELECT 1;\nSELECT 2;\n"), 0600); err != nil {
+		t.Fatalf("unable to setup test %v", err)
+	}
+	source, err := parser.NewQuerySource(conf.Args{SourceQueryFile: sourceFile}, completedSet{})
+	if err != nil {
+		t.Fatalf("unexpected %v", err)
+	}
+	defer source.Close()
+	for _, expected := range []string{"first", ""} {
+		q, err := source.Next()
+		if err != nil {
+			t.Fatalf("unexpected %v", err)
+		}
+		if label := q.Annotations[parser.AnnotationLabel]; label != expected {
+			t.Errorf("expected label %q for %q but had %q", expected, q.SQL, label)
+		}
+	}
+}
+
+func TestQuerySourceAppliesDefaultAnnotations(t *testing.T) {
+	sourceFile := filepath.Join(t.TempDir(), "queries.sql")
+	source := "-- @default-context: sales\nSELECT 1;\n" +
+		"-- @context: marketing\nSELECT 2;\n" +
+		"SELECT 3;\n" +
+		"-- @default-context: finance\n-- @label: four\nSELECT 4;\n" +
+		"SELECT 5;\n"
+	if err := os.WriteFile(sourceFile, []byte(source), 0600); err != nil {
+		t.Fatalf("unable to setup test %v", err)
+	}
+	// the first query is complete but the default it sets still applies
+	querySource, err := parser.NewQuerySource(conf.Args{SourceQueryFile: sourceFile}, completedSet{"-- @default-context: sales\nSELECT 1;": true})
+	if err != nil {
+		t.Fatalf("unexpected %v", err)
+	}
+	defer querySource.Close()
+	expected := []map[string]string{
+		{"context": "marketing"},
+		{"context": "sales"},
+		{"context": "finance", "label": "four"},
+		{"context": "finance"},
+	}
+	for _, e := range expected {
+		q, err := querySource.Next()
+		if err != nil {
+			t.Fatalf("unexpected %v", err)
+		}
+		if !reflect.DeepEqual(e, q.Annotations) {
+			t.Errorf("expected annotations %v for %q but had %v", e, q.SQL, q.Annotations)
+		}
+	}
+}
+
+func TestQuerySourceRejectsDuplicateLabels(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+	}{
+		{name: "label", source: "-- @label: sales\nSELECT 1;\nSELECT 2;\n-- @label: sales\nSELECT 3;\n"},
+		{name: "default label", source: "SELECT 1;\n-- @default-label: sales\nSELECT 2;\nSELECT 3;\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sourceFile := filepath.Join(t.TempDir(), "queries.sql")
+			if err := os.WriteFile(sourceFile, []byte(tt.source), 0600); err != nil {
+				t.Fatalf("unable to setup test %v", err)
+			}
+			source, err := parser.NewQuerySource(conf.Args{SourceQueryFile: sourceFile}, completedSet{})
+			if err == nil {
+				source.Close()
+				t.Fatal("expected an error for the duplicate label")
+			}
+			if !strings.Contains(err.Error(), "'sales'") {
+				t.Errorf("expected the error to name the label but had %v", err)
+			}
+		})
+	}
+}
+
+func TestQuerySourceRejectsInvalidAnnotations(t *testing.T) {
+	tests := []struct {
+		name       string
+		annotation string
+	}{
+		{name: "context", annotation: `-- @context: "sales"reporting`},
+		{name: "default context", annotation: "-- @default-context: sales..reporting"},
+		{name: "references", annotation: "-- @references: lake=snapshot:1"},
+		{name: "empty context", annotation: "-- @context"},
+		{name: "empty references", annotation: "-- @references:"},
+		{name: "empty label", annotation: "-- @label"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sourceFile := filepath.Join(t.TempDir(), "queries.sql")
+			if err := os.WriteFile(sourceFile, []byte("SELECT 1;\n"+tt.annotation+"\nSELECT 2;\n"), 0600); err != nil {
+				t.Fatalf("unable to setup test %v", err)
+			}
+			source, err := parser.NewQuerySource(conf.Args{SourceQueryFile: sourceFile}, completedSet{})
+			if err == nil {
+				source.Close()
+				t.Fatal("expected an error for the annotation")
+			}
+			if !strings.Contains(err.Error(), sourceFile+":3:") {
+				t.Errorf("expected the error to point at the statement on line 3 but had %v", err)
+			}
+		})
+	}
+}
+
+func TestQuerySourceRejectsAnnotationAfterStatement(t *testing.T) {
+	sourceFile := filepath.Join(t.TempDir(), "queries.sql")
+	if err := os.WriteFile(sourceFile, []byte("SELECT 1;\nSELECT 2; -- @label: second\nSELECT 3;\n"), 0600); err != nil {
+		t.Fatalf("unable to setup test %v", err)
+	}
+	source, err := parser.NewQuerySource(conf.Args{SourceQueryFile: sourceFile}, completedSet{})
+	if err == nil {
+		source.Close()
+		t.Fatal("expected an error for the annotation after the statement")
+	}
+	if !strings.Contains(err.Error(), sourceFile+":2:") {
+		t.Errorf("expected the error to point at the statement on line 2 but had %v", err)
+	}
+}
@@ -0,0 +1,351 @@
+//	Copyright 2023 Dremio Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type lexState int
+
+const (
+	stateNormal lexState = iota
+	stateSingleQuote
+	stateDoubleQuote
+	stateBacktick
+	stateLineComment
+	stateBlockComment
+	stateDollarQuote
+)
+
+// quoted is true for the states inside a string literal or a quoted identifier
+func (l lexState) quoted() bool {
+	return l == stateSingleQuote || l == stateDoubleQuote || l == stateBacktick || l == stateDollarQuote
+}
+
+// UnterminatedStatementError is returned when the input ends in the middle of a statement
+type UnterminatedStatementError struct {
+	File      string // File the statement was read from, blank when unknown
+	Line      int    // Line the statement starts on
+	Statement string // Statement text without a terminating ';'
+	Comment   bool   // Comment is true when the input ends inside a block comment
+}
+
+func (e *UnterminatedStatementError) Error() string {
+	const maxLength = 80
+	text := e.Statement
+	if len(text) > maxLength {
+		// cut on a rune boundary so the text stays valid UTF-8
+		cut := maxLength
+		for cut > 0 && !utf8.RuneStart(text[cut]) {
+			cut--
+		}
+		text = text[:cut] + "..."
+	}
+	location := fmt.Sprintf("line %v", e.Line)
+	if e.File != "" {
+		location = fmt.Sprintf("%v:%v", e.File, e.Line)
+	}
+	if e.Comment {
+		return fmt.Sprintf("statement starting at %v ends inside a block comment that is not closed by '*/': %q", location, text)
+	}
+	return fmt.Sprintf("statement starting at %v is not terminated by a ';': %q", location, text)
+}
+
+// Scanner splits SQL text into statements. A statement ends at a ';' that is not inside a
+// string literal, a quoted identifier, a comment or a dollar quoted literal, so several
+// statements may share a line and a statement may span many lines.
+// A quote inside a literal or identifier is escaped by doubling it, as Dremio does.
+// A line comment after the ';' on the same line belongs to the statement it follows.
+type Scanner struct {
+	// AllowUnterminated makes the final statement valid without a terminating ';',
+	// otherwise it is reported as an *UnterminatedStatementError by Err
+	AllowUnterminated bool
+	r                 *bufio.Reader
+	statement         string
+	statementLine     int
+	statementEnd      int64
+	trailingComment   string
+	line              int
+	offset            int64
+	err               error
+}
+
+// NewScanner returns a Scanner reading statements from r
+func NewScanner(r io.Reader) *Scanner {
+	return &Scanner{
+		r:    bufio.NewReader(r),
+		line: 1,
+	}
+}
+
+// Text returns the most recent statement found by Scan, including the terminating ';' and any
+// line comment after it on the same line
+func (s *Scanner) Text() string {
+	return s.statement
+}
+
+// TrailingComment returns the line comment after the ';' of the most recent statement, blank if there is none
+func (s *Scanner) TrailingComment() string {
+	return s.trailingComment
+}
+
+// Line returns the line number the most recent statement found by Scan starts on
+func (s *Scanner) Line() int {
+	return s.statementLine
+}
+
+// Offset returns the byte offset just past the most recent statement found by Scan
+func (s *Scanner) Offset() int64 {
+	return s.statementEnd
+}
+
+// Err returns the first non-EOF error encountered by the Scanner
+func (s *Scanner) Err() error {
+	return s.err
+}
+
+// Scan advances to the next statement, it returns false when the input is exhausted or an error occurs.
+// Statements that contain nothing but whitespace and comments are skipped.
+func (s *Scanner) Scan() bool {
+	var b strings.Builder
+	state := stateNormal
+	// significant is true once the statement has something other than whitespace or comments
+	significant := false
+	dollarTag := ""
+	startLine := s.line
+	s.trailingComment = ""
+	var prev rune
+	for {
+		r, size, err := s.r.ReadRune()
+		s.offset += int64(size)
+		if err == io.EOF {
+			text := strings.TrimRightFunc(b.String(), unicode.IsSpace)
+			if state == stateBlockComment {
+				// everything after the opening /* would be silently dropped
+				s.err = &UnterminatedStatementError{Line: startLine, Statement: text, Comment: true}
+				return false
+			}
+			if !significant {
+				return false
+			}
+			if !s.AllowUnterminated {
+				s.err = &UnterminatedStatementError{Line: startLine, Statement: text}
+				return false
+			}
+			s.statement = text
+			s.statementLine = startLine
+			s.statementEnd = s.offset
+			return true
+		}
+		if err != nil {
+			s.err = err
+			return false
+		}
+		if r == '\r' && s.peekIs('\n') && !state.quoted() {
+			// normalize windows line endings, literals and quoted identifiers are kept as written
+			continue
+		}
+		if r == '\n' {
+			s.line++
+		}
+		if state == stateNormal && !significant && !unicode.IsSpace(r) && !s.startsComment(r) && r != ';' {
+			// the statement starts at the first character that is not whitespace or a comment
+			startLine = s.line
+		}
+		switch state {
+		case stateNormal:
+			if b.Len() == 0 && unicode.IsSpace(r) {
+				// skip whitespace between statements
+				continue
+			}
+			switch {
+			case r == ';':
+				if !significant {
+					// empty statement, drop any comments collected so far
+					b.Reset()
+					prev = 0
+					continue
+				}
+				b.WriteRune(r)
+				if spaces, comment := s.readTrailingComment(); comment != "" {
+					b.WriteString(spaces)
+					b.WriteString(comment)
+					s.trailingComment = comment
+				}
+				s.statement = b.String()
+				s.statementLine = startLine
+				s.statementEnd = s.offset
+				return true
+			case r == '\'':
+				state = stateSingleQuote
+				significant = true
+			case r == '"':
+				state = stateDoubleQuote
+				significant = true
+			case r == '`':
+				state = stateBacktick
+				significant = true
+			case r == '-' && s.peekIs('-'):
+				state = stateLineComment
+			case r == '/' && s.peekIs('*'):
+				if !significant {
+					startLine = s.line
+				}
+				b.WriteRune(r)
+				r = s.readRune()
+				state = stateBlockComment
+			case r == '$' && !isIdentifierRune(prev):
+				if tag, ok := s.peekDollarTag(); ok {
+					b.WriteRune(r)
+					b.WriteString(tag)
+					s.discard(len(tag))
+					dollarTag = "$" + tag
+					state = stateDollarQuote
+					significant = true
+					prev = '$'
+					continue
+				}
+				significant = true
+			case !unicode.IsSpace(r):
+				significant = true
+			}
+		case stateSingleQuote:
+			if r == '\'' {
+				// a doubled quote closes and immediately reopens the literal
+				state = stateNormal
+			}
+		case stateDoubleQuote:
+			if r == '"' {
+				state = stateNormal
+			}
+		case stateBacktick:
+			if r == '`' {
+				state = stateNormal
+			}
+		case stateLineComment:
+			if r == '\n' {
+				state = stateNormal
+			}
+		case stateBlockComment:
+			if r == '*' && s.peekIs('/') {
+				b.WriteRune(r)
+				r = s.readRune()
+				state = stateNormal
+			}
+		case stateDollarQuote:
+			if r == '$' && s.peekString(dollarTag[1:]) {
+				b.WriteRune(r)
+				b.WriteString(dollarTag[1:])
+				s.discard(len(dollarTag) - 1)
+				state = stateNormal
+				prev = '$'
+				continue
+			}
+		}
+		b.WriteRune(r)
+		prev = r
+	}
+}
+
+func (s *Scanner) startsComment(r rune) bool {
+	return (r == '-' && s.peekIs('-')) || (r == '/' && s.peekIs('*'))
+}
+
+func (s *Scanner) peekIs(b byte) bool {
+	next, err := s.r.Peek(1)
+	return err == nil && next[0] == b
+}
+
+func (s *Scanner) peekString(str string) bool {
+	next, err := s.r.Peek(len(str))
+	return err == nil && string(next) == str
+}
+
+// readTrailingComment reads the spaces and the line comment that follow a ';' on the same line, up to but
+// not including the newline. Nothing is read when the rest of the line is not a comment, such as another statement
+func (s *Scanner) readTrailingComment() (spaces, comment string) {
+	n := 0
+	for {
+		next, err := s.r.Peek(n + 2)
+		if err != nil {
+			return "", ""
+		}
+		if next[n] == ' ' || next[n] == '\t' {
+			n++
+			continue
+		}
+		if string(next[n:]) != "--" {
+			return "", ""
+		}
+		break
+	}
+	next, _ := s.r.Peek(n)
+	spaces = string(next)
+	s.discard(n)
+	var b strings.Builder
+	for !s.peekIs('\n') {
+		r, size, err := s.r.ReadRune()
+		if err != nil {
+			break
+		}
+		s.offset += int64(size)
+		b.WriteRune(r)
+	}
+	return spaces, strings.TrimRightFunc(b.String(), unicode.IsSpace)
+}
+
+// readRune reads a rune that was already peeked so it cannot fail
+func (s *Scanner) readRune() rune {
+	r, size, _ := s.r.ReadRune()
+	s.offset += int64(size)
+	return r
+}
+
+func (s *Scanner) discard(n int) {
+	// the bytes were already peeked so this cannot fail
+	discarded, _ := s.r.Discard(n)
+	s.offset += int64(discarded)
+}
+
+// peekDollarTag looks for the remainder of a dollar quote opening such as $$ or $tag$
+// and returns it without the leading '$'
+func (s *Scanner) peekDollarTag() (string, bool) {
+	const maxTagLength = 64
+	for i := 1; i <= maxTagLength+1; i++ {
+		next, err := s.r.Peek(i)
+		if err != nil {
+			return "", false
+		}
+		c := next[i-1]
+		if c == '$' {
+			return string(next), true
+		}
+		if c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 1 && c >= '0' && c <= '9') {
+			continue
+		}
+		return "", false
+	}
+	return "", false
+}
+
+func isIdentifierRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
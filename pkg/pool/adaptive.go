@@ -0,0 +1,182 @@
+//	Copyright 2023 Dremio Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// ControllerConfig configures the adaptive concurrency of a Controller
+type ControllerConfig struct {
+	Initial       int           // Initial number of queries allowed to run at once
+	Min           int           // Min is the lowest the limit is ever reduced to
+	Max           int           // Max is the highest the limit is ever raised to
+	TargetLatency time.Duration // TargetLatency is the average time queries are queued above which the limit is reduced
+	MaxErrorRate  float64       // MaxErrorRate is the fraction of queries failing with retryable errors above which the limit is reduced
+	Interval      time.Duration // Interval is how often the limit is adjusted
+}
+
+// Controller limits how many threads run a query at once and adjusts that limit with additive increase,
+// multiplicative decrease. Each interval the limit grows by one while the average queued time and error rate
+// stay under their targets and the threads are using every slot, and is halved as soon as either goes over
+// its target, for example when Dremio starts queuing or failing jobs. A nil Controller allows everything
+type Controller struct {
+	cfg      ControllerConfig
+	lock     sync.Mutex
+	cond     *sync.Cond
+	limit    int
+	inUse    int
+	busy     bool
+	samples  int
+	failures int
+	queued   time.Duration
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewController validates the configuration and creates a Controller, call Start to begin adjusting
+func NewController(cfg ControllerConfig) (*Controller, error) {
+	if cfg.Min < 1 {
+		return nil, errors.New("minimum concurrency must be at least 1")
+	}
+	if cfg.Max < cfg.Min {
+		return nil, fmt.Errorf("maximum concurrency (%v) cannot be less than the minimum (%v)", cfg.Max, cfg.Min)
+	}
+	if cfg.Interval <= 0 {
+		return nil, errors.New("adjustment interval must be above 0")
+	}
+	limit := cfg.Initial
+	if limit < cfg.Min {
+		limit = cfg.Min
+	}
+	if limit > cfg.Max {
+		limit = cfg.Max
+	}
+	c := &Controller{
+		cfg:   cfg,
+		limit: limit,
+		done:  make(chan struct{}),
+	}
+	c.cond = sync.NewCond(&c.lock)
+	return c, nil
+}
+
+// Start adjusts the limit every interval until Stop is called
+func (c *Controller) Start() {
+	go func() {
+		ticker := time.NewTicker(c.cfg.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.done:
+				return
+			case <-ticker.C:
+				c.Adjust()
+			}
+		}
+	}()
+}
+
+// Stop ends the adjustments
+func (c *Controller) Stop() {
+	if c == nil {
+		return
+	}
+	c.stopOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+// Limit is the number of queries currently allowed to run at once
+func (c *Controller) Limit() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.limit
+}
+
+// Acquire blocks until the thread is allowed to run a query
+func (c *Controller) Acquire() {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for c.inUse >= c.limit {
+		c.busy = true
+		c.cond.Wait()
+	}
+	c.inUse++
+	if c.inUse >= c.limit {
+		c.busy = true
+	}
+}
+
+// Release frees the slot taken by Acquire
+func (c *Controller) Release() {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.inUse--
+	c.cond.Signal()
+}
+
+// Observe records how long one query submission was queued and whether it failed with an error that
+// could be caused by load, errors that fail on every attempt such as invalid SQL are not failures here
+func (c *Controller) Observe(queued time.Duration, failed bool) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.samples++
+	c.queued += queued
+	if failed {
+		c.failures++
+	}
+}
+
+// Adjust changes the limit based on the submissions observed since the last adjustment
+func (c *Controller) Adjust() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	samples, failures, queued, busy := c.samples, c.failures, c.queued, c.busy
+	c.samples, c.failures, c.queued, c.busy = 0, 0, 0, c.inUse >= c.limit
+	if samples == 0 {
+		return
+	}
+	avgQueued := queued / time.Duration(samples)
+	errorRate := float64(failures) / float64(samples)
+	previous := c.limit
+	switch {
+	case avgQueued > c.cfg.TargetLatency || errorRate > c.cfg.MaxErrorRate:
+		c.limit = c.limit / 2
+		if c.limit < c.cfg.Min {
+			c.limit = c.cfg.Min
+		}
+	case busy && c.limit < c.cfg.Max:
+		c.limit++
+		c.cond.Broadcast()
+	}
+	if c.limit != previous {
+		log.Printf("adjusting concurrency from %v to %v: average queued time %v (target %v), error rate %.1f%% (max %.1f%%) over %v queries",
+			previous, c.limit, avgQueued, c.cfg.TargetLatency, errorRate*100, c.cfg.MaxErrorRate*100, samples)
+	}
+}
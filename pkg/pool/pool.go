@@ -16,23 +16,94 @@ package pool
 
 import (
 	"errors"
-	"fmt"
+	"io"
+	"sync"
+
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/parser"
 )
 
-func DivideQueries(threads int, queries []string) (queriesByThread [][]string, err error) {
-	if threads == 0 {
-		return queriesByThread, errors.New("unable to have 0 threads")
-	}
-	if threads > len(queries) {
-		return queriesByThread, fmt.Errorf("unable to have more threads (%v) than queries (%v)", threads, len(queries))
+// Source provides queries one at a time and returns io.EOF once it has no more
+type Source interface {
+	Next() (parser.Statement, error)
+	Total() int
+}
+
+// Pool is a work queue shared by a number of threads, each thread takes the next query as soon as it
+// is free so a slow query only holds up the thread running it. Queries are handed out in the order of
+// the source, and only a few are read ahead so the source is never loaded in memory all at once
+type Pool struct {
+	queries   chan parser.Statement
+	threads   int
+	total     int
+	done      chan struct{}
+	closeOnce sync.Once
+	errLock   sync.Mutex
+	err       error
+}
+
+// NewPool starts reading the source into a work queue for the given number of threads. When there are
+// more threads than queries the extra threads simply find the queue empty
+func NewPool(threads int, source Source) (*Pool, error) {
+	if threads <= 0 {
+		return nil, errors.New("unable to have 0 threads")
 	}
-	queriesByThread = make([][]string, threads)
-	for i := 0; i < threads; i++ {
-		queriesByThread[i] = []string{}
+	p := &Pool{
+		// enough read ahead that a thread never waits on the source while another query is ready
+		queries: make(chan parser.Statement, threads),
+		threads: threads,
+		total:   source.Total(),
+		done:    make(chan struct{}),
 	}
-	for i := 0; i < len(queries); i++ {
-		currentThread := i % threads
-		queriesByThread[currentThread] = append(queriesByThread[currentThread], queries[i])
+	go p.dispatch(source)
+	return p, nil
+}
+
+func (p *Pool) dispatch(source Source) {
+	defer close(p.queries)
+	for {
+		q, err := source.Next()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			p.errLock.Lock()
+			p.err = err
+			p.errLock.Unlock()
+			return
+		}
+		select {
+		case p.queries <- q:
+		case <-p.done:
+			return
+		}
 	}
-	return
+}
+
+// Threads is the number of threads sharing the queue
+func (p *Pool) Threads() int {
+	return p.threads
+}
+
+// Total is the number of queries the pool will hand out
+func (p *Pool) Total() int {
+	return p.total
+}
+
+// Queries is the queue every thread takes its next query from, it is closed once the source is exhausted
+func (p *Pool) Queries() <-chan parser.Statement {
+	return p.queries
+}
+
+// Stop stops reading the source, threads will receive no new queries once the queue is empty
+func (p *Pool) Stop() {
+	p.closeOnce.Do(func() {
+		close(p.done)
+	})
+}
+
+// Err returns the error that stopped the source from being read, if any
+func (p *Pool) Err() error {
+	p.errLock.Lock()
+	defer p.errLock.Unlock()
+	return p.err
 }
@@ -15,81 +15,240 @@
 package pool_test
 
 import (
+	"io"
+	"reflect"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/parser"
 	"github.com/rsvihladremio/dremio-batch-execute/pkg/pool"
 )
 
-func TestPoolHasNoRemainders(t *testing.T) {
-	threads := 2
+type sliceSource struct {
+	queries []string
+	next    int
+}
+
+func (s *sliceSource) Next() (parser.Statement, error) {
+	if s.next >= len(s.queries) {
+		return parser.Statement{}, io.EOF
+	}
+	s.next++
+	return parser.Statement{SQL: s.queries[s.next-1], Line: s.next}, nil
+}
+
+func (s *sliceSource) Total() int {
+	return len(s.queries)
+}
+
+func TestPoolKeepsSourceOrder(t *testing.T) {
 	queries := []string{
 		"SELECT 1",
 		"SELECT 2",
 		"SELECT 3",
 		"SELECT 4",
+		"SELECT 5",
 	}
-	queryPool, err := pool.DivideQueries(threads, queries)
+	p, err := pool.NewPool(1, &sliceSource{queries: queries})
 	if err != nil {
 		t.Fatalf("unexpected %v", err)
 	}
-	if len(queryPool) != 2 {
-		t.Fatalf("expected 2 but had %v pools", len(queryPool))
+	if p.Total() != len(queries) {
+		t.Errorf("expected total of %v but had %v", len(queries), p.Total())
 	}
-
-	if len(queryPool[0]) != 2 {
-		t.Fatalf("expected pool 0 to have 2 but had %v queries", len(queryPool[0]))
+	received := []string{}
+	for q := range p.Queries() {
+		received = append(received, q.SQL)
 	}
+	if !reflect.DeepEqual(queries, received) {
+		t.Errorf("expected\n%q\nactual\n%q", queries, received)
+	}
+}
 
-	if len(queryPool[1]) != 2 {
-		t.Fatalf("expected pool 1 to have 2 but had %v queries", len(queryPool[1]))
+func TestPoolSlowThreadDoesNotStallOthers(t *testing.T) {
+	queries := []string{}
+	for i := 0; i < 100; i++ {
+		queries = append(queries, "SELECT 1")
+	}
+	p, err := pool.NewPool(2, &sliceSource{queries: queries})
+	if err != nil {
+		t.Fatalf("unexpected %v", err)
+	}
+	taken := make(chan struct{})
+	release := make(chan struct{})
+	counts := make([]int, 2)
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		// the slow thread takes one query and holds on to it
+		<-p.Queries()
+		counts[0]++
+		close(taken)
+		<-release
+		for range p.Queries() {
+			counts[0]++
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		<-taken
+		for range p.Queries() {
+			counts[1]++
+		}
+		close(release)
+	}()
+	select {
+	case <-release:
+	case <-time.After(5 * time.Second):
+		t.Fatal("fast thread was stalled by the slow thread")
+	}
+	wg.Wait()
+	if counts[0] != 1 || counts[1] != 99 {
+		t.Errorf("expected the fast thread to run the other 99 queries but counts were %v", counts)
 	}
 }
 
-func TestPoolHasSameThreadsAsQueries(t *testing.T) {
-	threads := 2
+func TestPoolHasMoreThreadsThanQueries(t *testing.T) {
 	queries := []string{
 		"SELECT 1",
 		"SELECT 2",
 	}
-	queryPool, err := pool.DivideQueries(threads, queries)
+	p, err := pool.NewPool(3, &sliceSource{queries: queries})
 	if err != nil {
 		t.Fatalf("unexpected %v", err)
 	}
-	if len(queryPool) != 2 {
-		t.Fatalf("expected 2 but had %v pools", len(queryPool))
+	wg := sync.WaitGroup{}
+	lock := sync.Mutex{}
+	received := 0
+	for i := 0; i < p.Threads(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range p.Queries() {
+				lock.Lock()
+				received++
+				lock.Unlock()
+			}
+		}()
 	}
-
-	if len(queryPool[0]) != 1 {
-		t.Fatalf("expected pool 0 to have 1 but had %v queries", len(queryPool[0]))
+	wg.Wait()
+	if received != 2 {
+		t.Errorf("expected 2 queries but had %v", received)
 	}
+}
 
-	if len(queryPool[1]) != 1 {
-		t.Fatalf("expected pool 1 to have 1 but had %v queries", len(queryPool[1]))
+func TestPoolHasNoThreads(t *testing.T) {
+	if _, err := pool.NewPool(0, &sliceSource{}); err == nil {
+		t.Fatal("expected an error")
 	}
 }
 
-func TestPoolHasRemainders(t *testing.T) {
-	threads := 2
-	queries := []string{
-		"SELECT 1",
-		"SELECT 2",
-		"SELECT 3",
-		"SELECT 4",
-		"SELECT 5",
+func TestPoolStopsReadingWhenStopped(t *testing.T) {
+	queries := make([]string, 1000)
+	for i := range queries {
+		queries[i] = "SELECT 1"
 	}
-	queryPool, err := pool.DivideQueries(threads, queries)
+	p, err := pool.NewPool(1, &sliceSource{queries: queries})
 	if err != nil {
 		t.Fatalf("unexpected %v", err)
 	}
-	if len(queryPool) != 2 {
-		t.Fatalf("expected 2 but had %v pools", len(queryPool))
+	<-p.Queries()
+	p.Stop()
+	received := 1
+	for range p.Queries() {
+		received++
 	}
+	if received == len(queries) {
+		t.Errorf("expected the pool to stop before handing out all %v queries", len(queries))
+	}
+}
 
-	if len(queryPool[0]) != 3 {
-		t.Fatalf("expected pool 0 to have 3 but had %v queries", len(queryPool[0]))
+func newController(t *testing.T, initial int) *pool.Controller {
+	t.Helper()
+	c, err := pool.NewController(pool.ControllerConfig{
+		Initial:       initial,
+		Min:           1,
+		Max:           4,
+		TargetLatency: time.Second,
+		MaxErrorRate:  0.1,
+		Interval:      time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("unexpected %v", err)
 	}
+	return c
+}
 
-	if len(queryPool[1]) != 2 {
-		t.Fatalf("expected pool 1 to have 2 but had %v queries", len(queryPool[1]))
+func TestControllerGrowsWhileHealthyAndBusy(t *testing.T) {
+	c := newController(t, 2)
+	for round := 0; round < 5; round++ {
+		// keep every slot busy
+		busy := c.Limit()
+		for i := 0; i < busy; i++ {
+			c.Acquire()
+		}
+		c.Observe(100*time.Millisecond, false)
+		c.Adjust()
+		for i := 0; i < busy; i++ {
+			c.Release()
+		}
+	}
+	if c.Limit() != 4 {
+		t.Errorf("expected the limit to grow to the maximum of 4 but was %v", c.Limit())
+	}
+}
+
+func TestControllerDoesNotGrowWhenIdle(t *testing.T) {
+	c := newController(t, 2)
+	c.Acquire()
+	c.Observe(100*time.Millisecond, false)
+	c.Release()
+	c.Adjust()
+	if c.Limit() != 2 {
+		t.Errorf("expected the limit to stay at 2 when threads are not all busy but was %v", c.Limit())
+	}
+}
+
+func TestControllerBacksOff(t *testing.T) {
+	c := newController(t, 4)
+	c.Observe(5*time.Second, false)
+	c.Adjust()
+	if c.Limit() != 2 {
+		t.Errorf("expected slow queries to halve the limit to 2 but was %v", c.Limit())
+	}
+	c.Observe(100*time.Millisecond, true)
+	c.Observe(100*time.Millisecond, false)
+	c.Adjust()
+	if c.Limit() != 1 {
+		t.Errorf("expected failures to halve the limit to 1 but was %v", c.Limit())
+	}
+	c.Observe(5*time.Second, true)
+	c.Adjust()
+	if c.Limit() != 1 {
+		t.Errorf("expected the limit to stay at the minimum of 1 but was %v", c.Limit())
+	}
+}
+
+func TestControllerLimitsConcurrency(t *testing.T) {
+	c := newController(t, 1)
+	c.Acquire()
+	acquired := make(chan struct{})
+	go func() {
+		c.Acquire()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("expected the second thread to wait for a slot")
+	case <-time.After(20 * time.Millisecond):
+	}
+	c.Release()
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the second thread to get the released slot")
 	}
+	c.Release()
 }
@@ -1,33 +1,65 @@
 package process
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/export"
 	"github.com/rsvihladremio/dremio-batch-execute/pkg/output"
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/parser"
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/pool"
 	"github.com/rsvihladremio/dremio-batch-execute/pkg/progress"
 	"github.com/rsvihladremio/dremio-batch-execute/pkg/protocol"
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/retry"
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/throttle"
 )
 
-func Execute(eng protocol.Engine, sleepTime time.Duration, progressFilePath string, queryPool [][]string) error {
+// Options configure how the queries of a pool are executed
+type Options struct {
+	SleepTime    time.Duration          // SleepTime is how long each thread waits after a query completes
+	Recorder     *progress.Recorder     // Recorder records the outcome of each query
+	FailedWriter *progress.FailedWriter // FailedWriter collects the queries that failed, nil disables it
+	Limiter      *throttle.Limiter      // Limiter limits the rate queries are submitted at across all threads, nil disables it
+	Controller   *pool.Controller       // Controller adapts how many threads run queries at once, nil runs every thread
+	Retry        retry.Policy           // Retry decides how many times a failed query is attempted
+	GracePeriod  time.Duration          // GracePeriod is how long running queries have to finish once the context is done
+	Results      *export.Exporter       // Results writes the rows returned by each query to a file, nil disables it
+	// Context and References apply to every query unless the query's annotations say otherwise, see newQuery
+	Context    []string
+	References map[string]protocol.Reference
+}
+
+// ErrInterrupted is returned when the context was done before every query was run, a context done after
+// that is not reported
+var ErrInterrupted = errors.New("interrupted before every query was run")
+
+// Execute runs every query in the pool with the given options. Once the context is done no more queries
+// are started, queries already running have the grace period to finish and are then canceled
+func Execute(ctx context.Context, eng protocol.Engine, queryPool *pool.Pool, opts Options) error {
+	recorder := opts.Recorder
+	failedWriter := opts.FailedWriter
 	progressLock := sync.Mutex{}
 	requestErrorLock := sync.Mutex{}
 	finishLock := sync.Mutex{}
 	wg := sync.WaitGroup{}
 	kill := false
 	var errorMessages []string
-	totalQueries := 0
-
-	for _, q := range queryPool {
-		totalQueries += len(q)
-	}
+	totalQueries := queryPool.Total()
 	completed := 0
 	failed := 0
 	finish := false
 	if totalQueries > 0 {
+		// running queries outlive the context by the grace period
+		running, cancelRunning := context.WithCancel(context.WithoutCancel(ctx))
+		defer cancelRunning()
+		finished := make(chan struct{})
+		defer close(finished)
+		go shutdown(ctx, cancelRunning, queryPool, opts.GracePeriod, finished)
 		go func() {
 			for {
 				time.Sleep(10 * time.Second)
@@ -47,52 +79,309 @@ func Execute(eng protocol.Engine, sleepTime time.Duration, progressFilePath stri
 			}
 		}()
 
-		for _, p := range queryPool {
+		for i := 0; i < queryPool.Threads(); i++ {
 			wg.Add(1)
-			go func(queriesForThread []string) {
+			go func(threadID int) {
 				defer wg.Done()
-				for threadID, q := range queriesForThread {
-					err := eng.Execute(q)
+				for {
+					opts.Controller.Acquire()
+					q, ok := <-queryPool.Queries()
+					if !ok || ctx.Err() != nil {
+						opts.Controller.Release()
+						return
+					}
+					record := progress.Record{
+						SQL:   q.SQL,
+						File:  q.File,
+						Line:  q.Line,
+						Start: time.Now(),
+					}
+					var err error
+					skipped := alreadyExported(opts.Results, q, &record)
+					if !skipped {
+						err = execute(ctx, running, eng, opts, q, &record)
+						// engines that stream the rows back already wrote them while the query ran
+						if err == nil && opts.Results.Exports(q) && record.ResultsFile == "" {
+							err = exportResults(running, opts.Results, q, &record)
+						}
+					}
+					record.End = time.Now()
+					opts.Controller.Release()
+					if err != nil && ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+						// interrupted before the query could finish, it is left for the next run
+						return
+					}
 					if err != nil {
-						log.Printf("error executing '%v' retrying with error: `%v`", q, err)
-						err = eng.Execute(q)
-						if err != nil {
-							requestErrorLock.Lock()
-							log.Printf("error executing '%v' with 1 retry due to error `%v`. Skipping query", q, err)
-							errorMessages = append(errorMessages, err.Error())
-							failed += 1
-							requestErrorLock.Unlock()
-							continue
+						record.State = progress.StateFailed
+						record.Error = err.Error()
+						requestErrorLock.Lock()
+						log.Printf("error executing '%v'%v after %v attempt(s) due to error `%v`. Skipping query", q.SQL, jobDescription(record.JobID), record.Attempts, err)
+						errorMessages = append(errorMessages, err.Error())
+						failed += 1
+						requestErrorLock.Unlock()
+						progressLock.Lock()
+						if err := recorder.Record(record); err != nil {
+							log.Printf("unable to record failure of query `%v` due to error `%v`", q.SQL, err)
 						}
+						progressLock.Unlock()
+						if failedWriter != nil {
+							if err := failedWriter.Write(record); err != nil {
+								log.Printf("unable to write query `%v` to the failed query file due to error `%v`", q.SQL, err)
+							}
+						}
+						continue
+					}
+					record.State = progress.StateCompleted
+					if !skipped {
+						time.Sleep(opts.SleepTime)
 					}
-					time.Sleep(sleepTime)
 					progressLock.Lock()
-					if err := progress.MarkQueryComplete(progressFilePath, q); err != nil {
+					if err := recorder.Record(record); err != nil {
 						kill = true
 						errorMessages = append(errorMessages, err.Error())
-						log.Printf("unable to mark query progress for query `%v` due to error `%v`, exiting, manually add this query to the progress file: %v and run the batch again", q, err, progressFilePath)
+						log.Printf("unable to mark query progress for query `%v` due to error `%v`, exiting, manually add this query to the progress file: %v and run the batch again", q.SQL, err, recorder.Path())
 					}
 					completed += 1
 					if kill {
+						progressLock.Unlock()
+						queryPool.Stop()
 						log.Printf("emergency stopping thread ID: %v", threadID)
 						return
 					}
 					progressLock.Unlock()
 				}
-			}(p)
+			}(i)
 		}
 		wg.Wait()
+		if err := queryPool.Err(); err != nil {
+			errorMessages = append(errorMessages, fmt.Sprintf("unable to read queries: %v", err))
+		}
 		finishLock.Lock()
 		finish = true
 		finishLock.Unlock()
 		output.LogQueriesCompleted(output.QueryResults{
-			Total:     totalQueries,
-			Failed:    failed,
-			Completed: completed,
+			Total:             totalQueries,
+			Failed:            failed,
+			Completed:         completed,
+			Reauthentications: reauthentications(eng),
 		})
 	}
+	// a signal that arrives once every query is recorded left nothing to run again
+	if ctx.Err() != nil && completed+failed < totalQueries {
+		if len(errorMessages) == 0 {
+			return ErrInterrupted
+		}
+		return fmt.Errorf("%w, errors during processing: %v", ErrInterrupted, strings.Join(errorMessages, ", "))
+	}
 	if len(errorMessages) == 0 {
 		return nil
 	}
 	return fmt.Errorf("errors during processing: %v", strings.Join(errorMessages, ", "))
 }
+
+// execute attempts the query as many times as the retry policy allows, stopping early for errors that
+// cannot succeed on another attempt, and counts the attempts in the record. Nothing new is started once
+// ctx is done while running queries are only canceled with running
+func execute(ctx, running context.Context, eng protocol.Engine, opts Options, statement parser.Statement, record *progress.Record) error {
+	q, err := newQuery(opts, statement)
+	if err != nil {
+		return err
+	}
+	if _, ok := eng.(protocol.QueryExecutor); !ok && (len(q.Context) > 0 || len(q.References) > 0) {
+		return fmt.Errorf("the %v protocol cannot run a query in a context or against references", eng.Name())
+	}
+	run := runner(eng, opts.Results, statement, record)
+	for {
+		result, err := submit(ctx, running, run, opts, q)
+		if result.JobID != "" {
+			setResult(record, result)
+		}
+		if err != nil && ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+			// interrupted before the query was submitted or canceled at the end of the grace period
+			return err
+		}
+		record.Attempts++
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			// no new attempts once shutting down
+			return err
+		}
+		if !retry.Retryable(err) {
+			log.Printf("error executing '%v'%v is not retryable: `%v`", q.SQL, jobDescription(result.JobID), err)
+			return err
+		}
+		if record.Attempts >= opts.Retry.Attempts() {
+			return err
+		}
+		backoff := opts.Retry.Backoff(record.Attempts)
+		log.Printf("error executing '%v'%v on attempt %v, retrying in %v with error: `%v`", q.SQL, jobDescription(result.JobID), record.Attempts, backoff, err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// alreadyExported is true when an earlier run wrote every row of the query's results but the query was
+// not recorded as completed, so the query does not need to run again
+func alreadyExported(results *export.Exporter, q parser.Statement, record *progress.Record) bool {
+	if !results.Exports(q) {
+		return false
+	}
+	written, err := results.Written(q)
+	if err != nil {
+		log.Printf("WARN: unable to check for the results of '%v', running it again: %v", q.SQL, err)
+		return false
+	}
+	if written {
+		record.ResultsFile = results.Path(q)
+		log.Printf("results of '%v' were already written to %v, skipping query", q.SQL, record.ResultsFile)
+	}
+	return written
+}
+
+// exportResults writes the rows the query returned to its results file
+func exportResults(ctx context.Context, results *export.Exporter, q parser.Statement, record *progress.Record) error {
+	if record.JobID == "" {
+		return fmt.Errorf("unable to export the results of '%v', the engine did not return a job id", q.SQL)
+	}
+	rows, err := results.Export(ctx, q, record.JobID)
+	if err != nil {
+		return fmt.Errorf("unable to export the results of job %v: %w", record.JobID, err)
+	}
+	record.ResultsFile = results.Path(q)
+	record.RowCount = &rows
+	return nil
+}
+
+// reauthentications is how many times the engine logged in again, 0 for engines that do not
+func reauthentications(eng protocol.Engine) int {
+	if r, ok := eng.(protocol.Reauthenticator); ok {
+		return r.Reauthentications()
+	}
+	return 0
+}
+
+// setResult copies the details of the job into the record
+func setResult(record *progress.Record, result protocol.Result) {
+	record.JobID = result.JobID
+	record.JobState = result.State
+	record.RowCount = result.RowCount
+	record.JobStart = result.Start
+	record.QueueStart = result.QueueStart
+	record.QueueEnd = result.QueueEnd
+	record.JobEnd = result.End
+	record.Accelerated = result.Accelerated
+}
+
+// jobDescription names the job in a log message, it is blank when the query was never submitted
+func jobDescription(jobID string) string {
+	if jobID == "" {
+		return ""
+	}
+	return fmt.Sprintf(" as job %v", jobID)
+}
+
+// newQuery reads the context and references of the statement from its annotations, falling back on the ones
+// in the options. References are merged so an annotation only replaces the version of the sources it names
+func newQuery(opts Options, statement parser.Statement) (protocol.Query, error) {
+	q := protocol.Query{
+		SQL:        statement.SQL,
+		Context:    opts.Context,
+		References: opts.References,
+	}
+	if path, ok := statement.Annotations[parser.AnnotationContext]; ok {
+		queryContext, err := protocol.ParseContext(path)
+		if err != nil {
+			return q, err
+		}
+		q.Context = queryContext
+	}
+	if list, ok := statement.Annotations[parser.AnnotationReferences]; ok {
+		references, err := protocol.ParseReferences(list)
+		if err != nil {
+			return q, err
+		}
+		merged := make(map[string]protocol.Reference, len(opts.References)+len(references))
+		for source, ref := range opts.References {
+			merged[source] = ref
+		}
+		for source, ref := range references {
+			merged[source] = ref
+		}
+		q.References = merged
+	}
+	return q, nil
+}
+
+// runner returns how to execute the statement. Engines that stream the rows back write them to the results file
+// while the query runs, otherwise the query runs with its context and references when the engine supports them,
+// execute makes sure queries that need them are not run with other engines
+func runner(eng protocol.Engine, results *export.Exporter, statement parser.Statement, record *progress.Record) func(context.Context, protocol.Query) (protocol.Result, error) {
+	if streamer, ok := eng.(protocol.ResultStreamer); ok && results.Exports(statement) {
+		return func(ctx context.Context, q protocol.Query) (protocol.Result, error) {
+			var result protocol.Result
+			_, err := results.Stream(statement, func(page func(protocol.ResultPage) error) error {
+				var err error
+				result, err = streamer.ExecuteStreaming(ctx, q.SQL, page)
+				return err
+			})
+			if err == nil {
+				record.ResultsFile = results.Path(statement)
+			}
+			return result, err
+		}
+	}
+	if executor, ok := eng.(protocol.QueryExecutor); ok {
+		return executor.ExecuteQuery
+	}
+	return func(ctx context.Context, q protocol.Query) (protocol.Result, error) {
+		return eng.Execute(ctx, q.SQL)
+	}
+}
+
+// submit waits for the limiter to allow another query, executes it and reports how it went to the controller.
+// Only retryable errors count as failures there, a query with invalid SQL says nothing about the load on Dremio
+func submit(ctx, running context.Context, run func(context.Context, protocol.Query) (protocol.Result, error), opts Options, q protocol.Query) (protocol.Result, error) {
+	if err := opts.Limiter.Wait(ctx); err != nil {
+		return protocol.Result{}, err
+	}
+	start := time.Now()
+	result, err := run(running, q)
+	opts.Controller.Observe(queued(result, time.Since(start)), retry.Retryable(err))
+	return result, err
+}
+
+// queued is how long the job waited for resources in Dremio, engines that do not report it fall back
+// to how long the query took
+func queued(result protocol.Result, elapsed time.Duration) time.Duration {
+	if result.QueueStart != nil && result.QueueEnd != nil {
+		return result.QueueEnd.Sub(*result.QueueStart)
+	}
+	return elapsed
+}
+
+// shutdown stops the pool once the context is done and cancels the queries still running after the grace period
+func shutdown(ctx context.Context, cancelRunning context.CancelFunc, queryPool *pool.Pool, gracePeriod time.Duration, finished <-chan struct{}) {
+	select {
+	case <-finished:
+		return
+	case <-ctx.Done():
+	}
+	log.Printf("shutting down, no new queries will be started and running queries have %v to finish", gracePeriod)
+	queryPool.Stop()
+	timer := time.NewTimer(gracePeriod)
+	defer timer.Stop()
+	select {
+	case <-finished:
+		return
+	case <-timer.C:
+	}
+	log.Printf("canceling the queries still running after %v", gracePeriod)
+	cancelRunning()
+}
@@ -0,0 +1,472 @@
+//	Copyright 2023 Dremio Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package process_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/conf"
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/export"
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/parser"
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/pool"
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/process"
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/progress"
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/protocol"
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/retry"
+)
+
+// newRecorder opens a text progress file in a temporary directory that is closed when the test ends
+func newRecorder(t *testing.T) *progress.Recorder {
+	t.Helper()
+	recorder, err := progress.OpenRecorder(filepath.Join(t.TempDir(), "progress.txt"), progress.FormatText, false, progress.SyncPolicy{})
+	if err != nil {
+		t.Fatalf("unable to setup test %v", err)
+	}
+	t.Cleanup(func() { recorder.Close() })
+	return recorder
+}
+
+type sliceSource struct {
+	queries []parser.Statement
+}
+
+func (s *sliceSource) Next() (parser.Statement, error) {
+	if len(s.queries) == 0 {
+		return parser.Statement{}, io.EOF
+	}
+	q := s.queries[0]
+	s.queries = s.queries[1:]
+	return q, nil
+}
+
+func (s *sliceSource) Total() int {
+	return len(s.queries)
+}
+
+// blockingEngine runs queries until they are canceled
+type blockingEngine struct {
+	started  chan string
+	lock     sync.Mutex
+	canceled bool
+}
+
+func (e *blockingEngine) Name() string {
+	return "test"
+}
+
+func (e *blockingEngine) Execute(ctx context.Context, query string) (protocol.Result, error) {
+	e.started <- query
+	<-ctx.Done()
+	e.lock.Lock()
+	e.canceled = true
+	e.lock.Unlock()
+	return protocol.Result{JobID: "1", State: "CANCELED"}, ctx.Err()
+}
+
+func TestExecuteShutdownCancelsRunningQueries(t *testing.T) {
+	recorder := newRecorder(t)
+	queryPool, err := pool.NewPool(1, &sliceSource{queries: []parser.Statement{{SQL: "SELECT 1;"}, {SQL: "SELECT 2;"}, {SQL: "SELECT 3;"}}})
+	if err != nil {
+		t.Fatalf("unable to setup test %v", err)
+	}
+	eng := &blockingEngine{started: make(chan string, 3)}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-eng.started
+		cancel()
+	}()
+	err = process.Execute(ctx, eng, queryPool, process.Options{
+		Recorder:    recorder,
+		GracePeriod: 10 * time.Millisecond,
+	})
+	if !errors.Is(err, process.ErrInterrupted) {
+		t.Fatalf("expected ErrInterrupted but had %v", err)
+	}
+	eng.lock.Lock()
+	defer eng.lock.Unlock()
+	if !eng.canceled {
+		t.Error("expected the running query to be canceled")
+	}
+	if len(eng.started) != 0 {
+		t.Errorf("expected no queries to start after the shutdown but %v did", len(eng.started))
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatalf("unexpected %v", err)
+	}
+	b, err := os.ReadFile(recorder.Path())
+	if err != nil {
+		t.Fatalf("unexpected %v", err)
+	}
+	if strings.TrimSpace(string(b)) != "" {
+		t.Errorf("expected no completed queries but had %q", b)
+	}
+}
+
+// cancelingEngine completes every query after canceling the context of the run, as a signal arriving
+// while the last query finishes would
+type cancelingEngine struct {
+	cancel context.CancelFunc
+}
+
+func (e *cancelingEngine) Name() string {
+	return "test"
+}
+
+func (e *cancelingEngine) Execute(_ context.Context, query string) (protocol.Result, error) {
+	e.cancel()
+	return protocol.Result{JobID: "1", State: "COMPLETED"}, nil
+}
+
+func TestExecuteNotInterruptedOnceEveryQueryRan(t *testing.T) {
+	queryPool, err := pool.NewPool(1, &sliceSource{queries: []parser.Statement{{SQL: "SELECT 1;"}}})
+	if err != nil {
+		t.Fatalf("unable to setup test %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err = process.Execute(ctx, &cancelingEngine{cancel: cancel}, queryPool, process.Options{
+		Recorder:    newRecorder(t),
+		GracePeriod: time.Second,
+	})
+	if err != nil {
+		t.Errorf("expected no error once every query ran but had %v", err)
+	}
+}
+
+// queuedEngine completes every query straight away after reporting it was queued for a while
+type queuedEngine struct {
+	queued time.Duration
+}
+
+func (e *queuedEngine) Name() string {
+	return "test"
+}
+
+func (e *queuedEngine) Execute(_ context.Context, query string) (protocol.Result, error) {
+	queueStart := time.Now()
+	queueEnd := queueStart.Add(e.queued)
+	return protocol.Result{JobID: "1", State: "COMPLETED", QueueStart: &queueStart, QueueEnd: &queueEnd}, nil
+}
+
+func TestExecuteControllerObservesQueuedTime(t *testing.T) {
+	recorder := newRecorder(t)
+	queryPool, err := pool.NewPool(1, &sliceSource{queries: []parser.Statement{{SQL: "SELECT 1;"}, {SQL: "SELECT 2;"}}})
+	if err != nil {
+		t.Fatalf("unable to setup test %v", err)
+	}
+	controller, err := pool.NewController(pool.ControllerConfig{Initial: 4, Min: 1, Max: 8, TargetLatency: time.Second, MaxErrorRate: 1, Interval: time.Hour})
+	if err != nil {
+		t.Fatalf("unable to setup test %v", err)
+	}
+	// the queries return straight away so only the queued time can be over the target
+	err = process.Execute(context.Background(), &queuedEngine{queued: 5 * time.Second}, queryPool, process.Options{
+		Recorder:   recorder,
+		Controller: controller,
+	})
+	if err != nil {
+		t.Fatalf("unexpected %v", err)
+	}
+	controller.Adjust()
+	if limit := controller.Limit(); limit != 2 {
+		t.Errorf("expected the limit to be halved to 2 but had %v", limit)
+	}
+}
+
+// failingEngine fails every query with err
+type failingEngine struct {
+	err error
+}
+
+func (e *failingEngine) Name() string {
+	return "test"
+}
+
+func (e *failingEngine) Execute(_ context.Context, query string) (protocol.Result, error) {
+	return protocol.Result{}, e.err
+}
+
+func TestExecuteControllerOnlyCountsRetryableErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected int
+	}{
+		{name: "permanent", err: errors.New("VALIDATION ERROR: table not found"), expected: 4},
+		{name: "retryable", err: errors.New("connection reset by peer"), expected: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queryPool, err := pool.NewPool(1, &sliceSource{queries: []parser.Statement{{SQL: "SELECT 1;"}, {SQL: "SELECT 2;"}}})
+			if err != nil {
+				t.Fatalf("unable to setup test %v", err)
+			}
+			controller, err := pool.NewController(pool.ControllerConfig{Initial: 4, Min: 1, Max: 8, TargetLatency: time.Hour, MaxErrorRate: 0, Interval: time.Hour})
+			if err != nil {
+				t.Fatalf("unable to setup test %v", err)
+			}
+			err = process.Execute(context.Background(), &failingEngine{err: tt.err}, queryPool, process.Options{
+				Recorder:   newRecorder(t),
+				Controller: controller,
+			})
+			if err == nil {
+				t.Fatal("expected the queries to fail")
+			}
+			controller.Adjust()
+			if limit := controller.Limit(); limit != tt.expected {
+				t.Errorf("expected the limit to be %v but had %v", tt.expected, limit)
+			}
+		})
+	}
+}
+
+func TestExecuteWithSQLEngine(t *testing.T) {
+	eng, err := protocol.NewSQLEngine(conf.ProtocolArgs{Driver: "sqlite", DSN: filepath.Join(t.TempDir(), "test.db")})
+	if err != nil {
+		t.Fatalf("unable to setup test %v", err)
+	}
+	defer eng.Close()
+	recorder := newRecorder(t)
+	queries := []parser.Statement{
+		{SQL: "CREATE TABLE t (n INTEGER);"},
+		{SQL: "INSERT INTO t VALUES (1), (2);"},
+		{SQL: "SELECT n FROM missing;"},
+		{SQL: "SELECT n FROM t;"},
+	}
+	queryPool, err := pool.NewPool(1, &sliceSource{queries: queries})
+	if err != nil {
+		t.Fatalf("unable to setup test %v", err)
+	}
+	err = process.Execute(context.Background(), eng, queryPool, process.Options{Recorder: recorder})
+	if err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Fatalf("expected the query on the missing table to fail but had %v", err)
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatalf("unexpected %v", err)
+	}
+	b, err := os.ReadFile(recorder.Path())
+	if err != nil {
+		t.Fatalf("unexpected %v", err)
+	}
+	expected := "CREATE TABLE t (n INTEGER);\nINSERT INTO t VALUES (1), (2);\nSELECT n FROM t;\n"
+	if string(b) != expected {
+		t.Errorf("expected progress file %q but had %q", expected, b)
+	}
+}
+
+// resultsEngine completes every query and returns a single row as the results of each job
+type resultsEngine struct {
+	lock     sync.Mutex
+	executed []string
+}
+
+func (e *resultsEngine) Name() string {
+	return "test"
+}
+
+func (e *resultsEngine) Execute(_ context.Context, query string) (protocol.Result, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.executed = append(e.executed, query)
+	return protocol.Result{JobID: fmt.Sprintf("job%v", len(e.executed)), State: "COMPLETED"}, nil
+}
+
+func (e *resultsEngine) ReadResults(_ context.Context, jobID string, page func(protocol.ResultPage) error) error {
+	return page(protocol.ResultPage{
+		Schema: []protocol.Column{{Name: "job", Type: "VARCHAR"}},
+		Rows:   []map[string]json.RawMessage{{"job": json.RawMessage(`"` + jobID + `"`)}},
+	})
+}
+
+func TestExecuteExportsResults(t *testing.T) {
+	eng := &resultsEngine{}
+	results, err := export.NewExporter(filepath.Join(t.TempDir(), "results"), export.FormatCSV, eng)
+	if err != nil {
+		t.Fatalf("unable to setup test %v", err)
+	}
+	recorder := newRecorder(t)
+	written := parser.Statement{SQL: "-- @label: written\nSELECT 1;", Annotations: map[string]string{"label": "written"}}
+	if err := os.WriteFile(results.Path(written), []byte("job\nearlier\n"), 0600); err != nil {
+		t.Fatalf("unable to setup test %v", err)
+	}
+	sales := parser.Statement{SQL: "-- @label: sales\nSELECT 2;", Annotations: map[string]string{"label": "sales"}}
+	queryPool, err := pool.NewPool(1, &sliceSource{queries: []parser.Statement{written, {SQL: "DROP TABLE t;"}, sales}})
+	if err != nil {
+		t.Fatalf("unable to setup test %v", err)
+	}
+	if err := process.Execute(context.Background(), eng, queryPool, process.Options{Recorder: recorder, Results: results}); err != nil {
+		t.Fatalf("unexpected %v", err)
+	}
+	expected := []string{"DROP TABLE t;", sales.SQL}
+	if !reflect.DeepEqual(expected, eng.executed) {
+		t.Errorf("expected only %q to be executed but was %q", expected, eng.executed)
+	}
+	for path, content := range map[string]string{
+		results.Path(written): "job\nearlier\n",
+		results.Path(sales):   "job\njob2\n",
+	} {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("unexpected %v", err)
+		}
+		if string(b) != content {
+			t.Errorf("expected %v to have %q but had %q", path, content, b)
+		}
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatalf("unexpected %v", err)
+	}
+	b, err := os.ReadFile(recorder.Path())
+	if err != nil {
+		t.Fatalf("unexpected %v", err)
+	}
+	if lines := strings.Count(string(b), ";\n"); lines != 3 {
+		t.Errorf("expected every query to be recorded as completed but had %q", b)
+	}
+}
+
+// streamingEngine hands back the rows of every query while it runs, the first attempt fails half way through
+type streamingEngine struct {
+	attempts int
+}
+
+func (e *streamingEngine) Name() string {
+	return "test"
+}
+
+func (e *streamingEngine) Execute(ctx context.Context, query string) (protocol.Result, error) {
+	return e.ExecuteStreaming(ctx, query, nil)
+}
+
+func (e *streamingEngine) ExecuteStreaming(_ context.Context, query string, page func(protocol.ResultPage) error) (protocol.Result, error) {
+	e.attempts++
+	schema := []protocol.Column{{Name: "attempt", Type: "INTEGER"}}
+	if page != nil {
+		row := map[string]json.RawMessage{"attempt": json.RawMessage(fmt.Sprint(e.attempts))}
+		if err := page(protocol.ResultPage{Schema: schema, Rows: []map[string]json.RawMessage{row}}); err != nil {
+			return protocol.Result{}, err
+		}
+	}
+	if e.attempts == 1 {
+		return protocol.Result{}, errors.New("connection reset")
+	}
+	return protocol.Result{JobID: "1", State: "COMPLETED"}, nil
+}
+
+func TestExecuteStreamsResults(t *testing.T) {
+	eng := &streamingEngine{}
+	results, err := export.NewExporter(filepath.Join(t.TempDir(), "results"), export.FormatCSV, nil)
+	if err != nil {
+		t.Fatalf("unable to setup test %v", err)
+	}
+	recorder := newRecorder(t)
+	statement := parser.Statement{SQL: "SELECT 1;"}
+	queryPool, err := pool.NewPool(1, &sliceSource{queries: []parser.Statement{statement}})
+	if err != nil {
+		t.Fatalf("unable to setup test %v", err)
+	}
+	err = process.Execute(context.Background(), eng, queryPool, process.Options{
+		Recorder: recorder,
+		Results:  results,
+		Retry:    retry.Policy{MaxAttempts: 2},
+	})
+	if err != nil {
+		t.Fatalf("unexpected %v", err)
+	}
+	// only the rows of the attempt that completed are kept
+	b, err := os.ReadFile(results.Path(statement))
+	if err != nil {
+		t.Fatalf("unexpected %v", err)
+	}
+	if string(b) != "attempt\n2\n" {
+		t.Errorf("expected the rows of the second attempt but had %q", b)
+	}
+}
+
+// queryEngine records the context and references of every query it runs
+type queryEngine struct {
+	resultsEngine
+	queries []protocol.Query
+}
+
+func (e *queryEngine) ExecuteQuery(ctx context.Context, q protocol.Query) (protocol.Result, error) {
+	e.lock.Lock()
+	e.queries = append(e.queries, q)
+	e.lock.Unlock()
+	return e.Execute(ctx, q.SQL)
+}
+
+func TestExecuteSetsContextAndReferences(t *testing.T) {
+	recorder := newRecorder(t)
+	queries := []parser.Statement{
+		{SQL: "SELECT 1;"},
+		{SQL: "SELECT 2;", Annotations: map[string]string{"context": "marketing.reports", "references": "arctic=tag:v1"}},
+		{SQL: "SELECT 3;", Annotations: map[string]string{"references": "lake=snapshot:1"}},
+	}
+	queryPool, err := pool.NewPool(1, &sliceSource{queries: queries})
+	if err != nil {
+		t.Fatalf("unable to setup test %v", err)
+	}
+	eng := &queryEngine{}
+	err = process.Execute(context.Background(), eng, queryPool, process.Options{
+		Recorder:   recorder,
+		Context:    []string{"sales"},
+		References: map[string]protocol.Reference{"lake": {Type: "BRANCH", Value: "dev"}},
+	})
+	if err == nil || !strings.Contains(err.Error(), "snapshot") {
+		t.Fatalf("expected the query with an invalid reference to fail but had %v", err)
+	}
+	expected := []protocol.Query{
+		{SQL: "SELECT 1;", Context: []string{"sales"}, References: map[string]protocol.Reference{"lake": {Type: "BRANCH", Value: "dev"}}},
+		{SQL: "SELECT 2;", Context: []string{"marketing", "reports"}, References: map[string]protocol.Reference{
+			"lake":   {Type: "BRANCH", Value: "dev"},
+			"arctic": {Type: "TAG", Value: "v1"},
+		}},
+	}
+	if !reflect.DeepEqual(expected, eng.queries) {
+		t.Errorf("expected queries\n%v\nbut had\n%v", expected, eng.queries)
+	}
+}
+
+func TestExecuteContextNeedsQueryExecutor(t *testing.T) {
+	recorder := newRecorder(t)
+	queryPool, err := pool.NewPool(1, &sliceSource{queries: []parser.Statement{
+		{SQL: "SELECT 1;"},
+		{SQL: "SELECT 2;", Annotations: map[string]string{"context": "sales"}},
+	}})
+	if err != nil {
+		t.Fatalf("unable to setup test %v", err)
+	}
+	eng := &resultsEngine{}
+	err = process.Execute(context.Background(), eng, queryPool, process.Options{Recorder: recorder, Retry: retry.Policy{MaxAttempts: 3}})
+	if err == nil || !strings.Contains(err.Error(), "context") {
+		t.Fatalf("expected the query with a context to fail but had %v", err)
+	}
+	if !reflect.DeepEqual([]string{"SELECT 1;"}, eng.executed) {
+		t.Errorf("expected only the query without a context to run but had %q", eng.executed)
+	}
+}
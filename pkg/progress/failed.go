@@ -0,0 +1,81 @@
+//	Copyright 2023 Dremio Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package progress
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// FailedWriter collects the queries that failed in a file that can be fixed and used as the source file of
+// another run. Each query is preceded by comments with where it came from and the error it failed with
+type FailedWriter struct {
+	lock sync.Mutex
+	f    *os.File
+}
+
+// CreateFailedWriter creates the failed query file, replacing any previous one
+func CreateFailedWriter(failedFilePath string) (*FailedWriter, error) {
+	f, err := os.OpenFile(failedFilePath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create failed query file: %v", err)
+	}
+	return &FailedWriter{f: f}, nil
+}
+
+// Write appends the failed query described by the record
+func (w *FailedWriter) Write(record Record) error {
+	var b strings.Builder
+	if record.File != "" {
+		fmt.Fprintf(&b, "-- source: %v:%v\n", record.File, record.Line)
+	}
+	fmt.Fprintf(&b, "-- attempts: %v\n", record.Attempts)
+	if record.JobID != "" {
+		fmt.Fprintf(&b, "-- job: %v\n", record.JobID)
+	}
+	for i, line := range strings.Split(strings.TrimSpace(record.Error), "\n") {
+		if i == 0 {
+			fmt.Fprintf(&b, "-- error: %v\n", line)
+		} else {
+			fmt.Fprintf(&b, "--   %v\n", line)
+		}
+	}
+	sql := strings.TrimSpace(record.SQL)
+	b.WriteString(sql)
+	if !strings.HasSuffix(sql, ";") {
+		// on its own line so that a trailing line comment cannot swallow it
+		b.WriteString("\n;")
+	}
+	b.WriteString("\n\n")
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if _, err := w.f.WriteString(b.String()); err != nil {
+		return fmt.Errorf("unable to write failed query file: %v", err)
+	}
+	return nil
+}
+
+// Close flushes and closes the failed query file
+func (w *FailedWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if err := w.f.Sync(); err != nil {
+		w.f.Close()
+		return err
+	}
+	return w.f.Close()
+}
@@ -0,0 +1,395 @@
+//	Copyright 2023 Dremio Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package progress
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/parser"
+)
+
+// Format of the progress file
+type Format string
+
+const (
+	// FormatText is the legacy format, the text of each completed query terminated by a ';'
+	FormatText Format = "text"
+	// FormatJSONL writes one JSON Record per line for every query that finished, completed or not
+	FormatJSONL Format = "jsonl"
+)
+
+// ParseFormat validates a format name, a blank name is FormatText
+func ParseFormat(name string) (Format, error) {
+	switch Format(name) {
+	case "", FormatText:
+		return FormatText, nil
+	case FormatJSONL:
+		return FormatJSONL, nil
+	}
+	return "", fmt.Errorf("unsupported progress format '%v' only '%v' and '%v' are supported", name, FormatText, FormatJSONL)
+}
+
+// final states of a query in the progress journal
+const (
+	StateCompleted = "COMPLETED"
+	StateFailed    = "FAILED"
+)
+
+// Record describes one execution of a query in a JSONL progress journal
+type Record struct {
+	Hash     string    `json:"hash"`
+	SQL      string    `json:"sql,omitempty"`
+	File     string    `json:"file,omitempty"`
+	Line     int       `json:"line,omitempty"`
+	JobID    string    `json:"job_id,omitempty"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Attempts int       `json:"attempts"`
+	State    string    `json:"state"`
+	RowCount *int64    `json:"row_count,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	// the details Dremio reported for the last attempt, see protocol.Result
+	JobState    string     `json:"job_state,omitempty"`
+	JobStart    *time.Time `json:"job_start,omitempty"`
+	QueueStart  *time.Time `json:"queue_start,omitempty"`
+	QueueEnd    *time.Time `json:"queue_end,omitempty"`
+	JobEnd      *time.Time `json:"job_end,omitempty"`
+	Accelerated bool       `json:"accelerated,omitempty"`
+	// ResultsFile is where the rows the query returned were exported to, see export.Exporter
+	ResultsFile string `json:"results_file,omitempty"`
+}
+
+// DetectFormat looks at the first character of an existing progress file to find its format,
+// ok is false when the file is missing or empty
+func DetectFormat(progressFilePath string) (format Format, ok bool, err error) {
+	f, err := os.Open(progressFilePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+	return detectFormat(bufio.NewReader(f))
+}
+
+// detectFormat peeks at the reader without consuming anything a format reader needs
+func detectFormat(r *bufio.Reader) (Format, bool, error) {
+	for {
+		c, _, err := r.ReadRune()
+		if err == io.EOF {
+			return "", false, nil
+		}
+		if err != nil {
+			return "", false, err
+		}
+		if unicode.IsSpace(c) {
+			continue
+		}
+		if err := r.UnreadRune(); err != nil {
+			return "", false, err
+		}
+		if c == '{' {
+			return FormatJSONL, true, nil
+		}
+		return FormatText, true, nil
+	}
+}
+
+// SyncPolicy controls how often the progress file is flushed to disk with fsync, whatever the policy
+// the file is always flushed when the Recorder is closed
+type SyncPolicy struct {
+	EveryRecords int           // EveryRecords flushes after this many records, 1 flushes every record and 0 disables it
+	Interval     time.Duration // Interval flushes records older than this, 0 disables it
+}
+
+// Recorder appends the outcome of each query to a progress file, it keeps the file open until Close is called
+// and is safe to use from several goroutines
+type Recorder struct {
+	path     string
+	format   Format
+	hashOnly bool
+	policy   SyncPolicy
+	lock     sync.Mutex
+	f        *os.File
+	unsynced int
+	closed   bool
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// OpenRecorder opens the progress file for appending in the requested format. When the file already has
+// records its format is kept, so that resuming a run never mixes formats in one file, and a record left
+// partially written by a crash is removed. With hashOnly the text of the query is left out and only
+// its hash is written.
+func OpenRecorder(progressFilePath string, format Format, hashOnly bool, policy SyncPolicy) (*Recorder, error) {
+	existing, ok, err := DetectFormat(progressFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read progress file: %v", err)
+	}
+	if ok {
+		format = existing
+		if err := Repair(progressFilePath, format); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.OpenFile(progressFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open progress file: %v", err)
+	}
+	r := &Recorder{
+		path:     progressFilePath,
+		format:   format,
+		hashOnly: hashOnly,
+		policy:   policy,
+		f:        f,
+		done:     make(chan struct{}),
+	}
+	if policy.Interval > 0 {
+		r.wg.Add(1)
+		go r.syncEvery(policy.Interval)
+	}
+	return r, nil
+}
+
+// Path of the progress file
+func (r *Recorder) Path() string {
+	return r.path
+}
+
+// Format the progress file is written in
+func (r *Recorder) Format() Format {
+	return r.format
+}
+
+// Record appends the record to the progress file. The text format only keeps completed queries
+func (r *Recorder) Record(record Record) error {
+	var entry string
+	if r.format == FormatText {
+		if record.State != StateCompleted {
+			return nil
+		}
+		entry = terminate(record.SQL)
+		if r.hashOnly {
+			entry = hashPrefix + Hash(record.SQL) + ";"
+		}
+	} else {
+		if record.Hash == "" {
+			record.Hash = Hash(record.SQL)
+		}
+		if r.hashOnly {
+			record.SQL = ""
+		}
+		line, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("unable to write progress record: %v", err)
+		}
+		entry = string(line)
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return errors.New("progress file is already closed")
+	}
+	// a single write per record so that a crash can only tear the last record
+	if _, err := r.f.WriteString(entry + "\n"); err != nil {
+		return fmt.Errorf("unable to write progress file: %v", err)
+	}
+	r.unsynced++
+	if r.policy.EveryRecords > 0 && r.unsynced >= r.policy.EveryRecords {
+		return r.sync()
+	}
+	return nil
+}
+
+// Close flushes any remaining records to disk and closes the progress file
+func (r *Recorder) Close() error {
+	r.lock.Lock()
+	if r.closed {
+		r.lock.Unlock()
+		return nil
+	}
+	r.closed = true
+	close(r.done)
+	r.lock.Unlock()
+	r.wg.Wait()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	syncErr := r.sync()
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	return syncErr
+}
+
+func (r *Recorder) syncEvery(interval time.Duration) {
+	defer r.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+			r.lock.Lock()
+			if err := r.sync(); err != nil {
+				log.Printf("WARN: unable to flush progress file: %v", err)
+			}
+			r.lock.Unlock()
+		}
+	}
+}
+
+// sync must be called while holding the lock
+func (r *Recorder) sync() error {
+	if r.unsynced == 0 {
+		return nil
+	}
+	if err := r.f.Sync(); err != nil {
+		return fmt.Errorf("unable to flush progress file: %v", err)
+	}
+	r.unsynced = 0
+	return nil
+}
+
+// terminate makes sure the query ends with a ';' so that every complete record in a text progress file
+// can be told apart from one torn by a crash. The ';' goes on its own line so that a trailing line comment,
+// possible on a final statement accepted without one, cannot swallow it
+func terminate(query string) string {
+	if strings.HasSuffix(query, ";") {
+		return query
+	}
+	return query + "\n;"
+}
+
+// Repair truncates the progress file after its last complete record, removing a record that was only
+// partially written when a previous run crashed. It also ends the file with a newline so that the
+// next record starts on its own line
+func Repair(progressFilePath string, format Format) error {
+	f, err := os.OpenFile(progressFilePath, os.O_RDWR, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to open progress file: %v", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	var valid int64
+	if format == FormatJSONL {
+		valid, err = validJSONLLength(f, size)
+	} else {
+		valid, err = validTextLength(f, size)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read progress file %v: %v", progressFilePath, err)
+	}
+	if valid < size {
+		torn := make([]byte, size-valid)
+		if _, err := f.ReadAt(torn, valid); err != nil {
+			return err
+		}
+		log.Printf("WARN: removing partially written record from progress file %v: %q", progressFilePath, string(torn))
+		if err := f.Truncate(valid); err != nil {
+			return fmt.Errorf("unable to repair progress file %v: %v", progressFilePath, err)
+		}
+		size = valid
+	}
+	if size > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, size-1); err != nil {
+			return err
+		}
+		if last[0] != '\n' {
+			if _, err := f.WriteAt([]byte("\n"), size); err != nil {
+				return fmt.Errorf("unable to repair progress file %v: %v", progressFilePath, err)
+			}
+		}
+	}
+	return f.Sync()
+}
+
+// validTextLength is the length of the file up to the end of its last complete record and line
+func validTextLength(f *os.File, size int64) (int64, error) {
+	scanner := parser.NewScanner(f)
+	for scanner.Scan() {
+		// only the end of the last complete record matters
+	}
+	var unterminated *parser.UnterminatedStatementError
+	err := scanner.Err()
+	if err == nil {
+		return size, nil
+	}
+	if !errors.As(err, &unterminated) {
+		return 0, err
+	}
+	return lineEnd(f, scanner.Offset())
+}
+
+// lineEnd moves the offset past the rest of the line it is on when the remainder of the line is only whitespace
+func lineEnd(f *os.File, offset int64) (int64, error) {
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	r := bufio.NewReader(f)
+	for {
+		c, err := r.ReadByte()
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		if c == '\n' {
+			return offset + 1, nil
+		}
+		if c != ' ' && c != '\t' && c != '\r' {
+			return offset, nil
+		}
+		offset++
+	}
+}
+
+// validJSONLLength is the length of the file up to the end of its last complete JSON line
+func validJSONLLength(f *os.File, size int64) (int64, error) {
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(bytes.TrimSpace(line)) == 0 || json.Valid(line) {
+				// complete record that is only missing its newline
+				return size, nil
+			}
+			return offset, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		offset += int64(len(line))
+	}
+}
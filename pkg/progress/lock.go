@@ -0,0 +1,148 @@
+//	Copyright 2023 Dremio Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package progress
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// errLockHeld is returned by lockFile when another process holds the advisory lock
+var errLockHeld = errors.New("lock is held by another process")
+
+// LockInfo is written to the lock file so that other runs can report who holds it
+type LockInfo struct {
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Started time.Time `json:"started"`
+}
+
+// LockedError is returned by AcquireLock when another run is using the progress file
+type LockedError struct {
+	Path   string   // Path of the lock file
+	Holder LockInfo // Holder is the run that has the lock
+	Live   bool     // Live is true when the holder is known to still be running
+}
+
+func (e *LockedError) Error() string {
+	if e.Live {
+		return fmt.Sprintf("progress file is in use by pid %v on host %v started at %v, wait for it to finish before starting another run (lock file %v)",
+			e.Holder.PID, e.Holder.Host, e.Holder.Started.Format(time.RFC3339), e.Path)
+	}
+	return fmt.Sprintf("progress file was locked by pid %v on host %v started at %v and it cannot be verified that this run has stopped, if it has use -force-unlock (lock file %v)",
+		e.Holder.PID, e.Holder.Host, e.Holder.Started.Format(time.RFC3339), e.Path)
+}
+
+// Lock is an exclusive hold on a progress file, it lasts until Release is called or the process exits
+type Lock struct {
+	path string
+	f    *os.File
+}
+
+// LockPath is the lock file used for a progress file
+func LockPath(progressFilePath string) string {
+	return progressFilePath + ".lock"
+}
+
+// AcquireLock takes an exclusive lock on the progress file so that two runs never write to it at once.
+// The lock is an advisory lock on the lock file where the platform supports it, and the lock file records
+// the pid, host and start time of the run holding it. A lock file left behind by a run that has stopped
+// on this host is taken over, while one from another host is only taken over when forceUnlock is set.
+func AcquireLock(progressFilePath string, forceUnlock bool) (*Lock, error) {
+	path := LockPath(progressFilePath)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open lock file: %v", err)
+	}
+	existing, hasExisting := readLockInfo(f)
+	if err := lockFile(f); err != nil {
+		f.Close()
+		if errors.Is(err, errLockHeld) {
+			return nil, &LockedError{Path: path, Holder: existing, Live: true}
+		}
+		return nil, fmt.Errorf("unable to lock %v: %v", path, err)
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("unable to read hostname: %v", err)
+	}
+	if hasExisting {
+		stale := existing.Host == host && (advisoryLockSupported || !processAlive(existing.PID))
+		switch {
+		case stale:
+			log.Printf("taking over stale lock left by pid %v on host %v started at %v", existing.PID, existing.Host, existing.Started.Format(time.RFC3339))
+		case forceUnlock:
+			log.Printf("forcing unlock of lock held by pid %v on host %v started at %v", existing.PID, existing.Host, existing.Started.Format(time.RFC3339))
+		default:
+			f.Close()
+			return nil, &LockedError{Path: path, Holder: existing, Live: existing.Host == host}
+		}
+	}
+	info, err := json.Marshal(LockInfo{
+		PID:     os.Getpid(),
+		Host:    host,
+		Started: time.Now(),
+	})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := writeLockInfo(f, info); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("unable to write lock file %v: %v", path, err)
+	}
+	return &Lock{path: path, f: f}, nil
+}
+
+// Release empties the lock file and gives up the lock. The file is kept, removing it would let a run
+// that already opened it lock the removed file while another run creates and locks a new one
+func (l *Lock) Release() error {
+	truncateErr := l.f.Truncate(0)
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	if truncateErr != nil {
+		return fmt.Errorf("unable to empty lock file %v: %v", l.path, truncateErr)
+	}
+	return nil
+}
+
+func readLockInfo(f *os.File) (LockInfo, bool) {
+	var info LockInfo
+	content, err := io.ReadAll(f)
+	if err != nil || len(content) == 0 {
+		return info, false
+	}
+	if err := json.Unmarshal(content, &info); err != nil {
+		return info, false
+	}
+	return info, true
+}
+
+func writeLockInfo(f *os.File, info []byte) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(info, 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
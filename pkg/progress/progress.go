@@ -15,10 +15,131 @@
 package progress
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"strings"
+
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/parser"
 )
 
+// hashPrefix marks a progress file entry that records only the hash of a query
+const hashPrefix = "sha256:"
+
+// Hash identifies a query in the progress file, it is the hex encoded SHA-256 of the normalized query.
+// Surrounding whitespace and the terminating ';' are not part of the hash
+func Hash(query string) string {
+	sum := sha256.Sum256([]byte(normalize(query)))
+	return hex.EncodeToString(sum[:])
+}
+
+func normalize(query string) string {
+	return strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(query), ";"))
+}
+
+// Index is the set of queries recorded in a progress file, kept as hashes so that lookups
+// are constant time and memory does not depend on the length of the queries
+type Index struct {
+	hashes map[string]struct{}
+}
+
+// LoadIndex reads every query recorded as complete in the progress file, a missing file is an empty index.
+// Both the plain text and the JSONL formats are read, see DetectFormat
+func LoadIndex(progressFilePath string) (*Index, error) {
+	index := &Index{
+		hashes: make(map[string]struct{}),
+	}
+	f, err := os.Open(progressFilePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to open progress file: %v", err)
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	format, ok, err := detectFormat(reader)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read progress file %v: %v", progressFilePath, err)
+	}
+	if !ok {
+		return index, nil
+	}
+	if format == FormatJSONL {
+		err = index.loadJSONL(reader)
+	} else {
+		err = index.loadText(reader)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read progress file %v: %v", progressFilePath, err)
+	}
+	return index, nil
+}
+
+func (i *Index) loadText(r io.Reader) error {
+	scanner := parser.NewScanner(r)
+	// a Recorder terminates a final query accepted without a ';' with one on its own line, but
+	// files written by MarkQueryComplete or older versions can still end without one
+	scanner.AllowUnterminated = true
+	for scanner.Scan() {
+		entry := normalize(scanner.Text())
+		if h, ok := strings.CutPrefix(entry, hashPrefix); ok && isHash(h) {
+			i.hashes[h] = struct{}{}
+			continue
+		}
+		i.hashes[Hash(entry)] = struct{}{}
+	}
+	return scanner.Err()
+}
+
+func (i *Index) loadJSONL(r *bufio.Reader) error {
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := r.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var record Record
+			if jsonErr := json.Unmarshal(line, &record); jsonErr != nil {
+				return fmt.Errorf("invalid record on line %v: %v", lineNumber, jsonErr)
+			}
+			if record.State == StateCompleted {
+				i.hashes[record.Hash] = struct{}{}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Contains is true when the query was recorded as complete
+func (i *Index) Contains(query string) bool {
+	_, ok := i.hashes[Hash(query)]
+	return ok
+}
+
+// Len is the number of distinct queries in the index
+func (i *Index) Len() int {
+	return len(i.hashes)
+}
+
+func isHash(s string) bool {
+	if len(s) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// MarkQueryComplete appends the query to a plain text progress file, a Recorder should be used
+// when recording many queries as it keeps the file open
 func MarkQueryComplete(progressFilePath string, queryLine string) error {
 	f, err := os.OpenFile(progressFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
 	if err != nil {
@@ -26,7 +147,8 @@ func MarkQueryComplete(progressFilePath string, queryLine string) error {
 	}
 	_, err = f.WriteString(queryLine + "\n")
 	if err != nil {
+		f.Close()
 		return err
 	}
-	return nil
+	return f.Close()
 }
@@ -15,10 +15,15 @@
 package progress_test
 
 import (
+	"encoding/json"
+	"errors"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/parser"
 	"github.com/rsvihladremio/dremio-batch-execute/pkg/progress"
 )
 
@@ -62,3 +67,382 @@ INSERT INTO TABLE A.C VALUES (1,2);
 		}
 	}
 }
+
+func TestLoadIndex(t *testing.T) {
+	progressFilePath := filepath.Join(t.TempDir(), "progress.txt")
+
+	if err := progress.MarkQueryComplete(progressFilePath, "INSERT INTO a.b VALUES(';');"); err != nil {
+		t.Fatalf("unexpected failure %v", err)
+	}
+	recorder, err := progress.OpenRecorder(progressFilePath, progress.FormatText, true, progress.SyncPolicy{})
+	if err != nil {
+		t.Fatalf("unexpected failure %v", err)
+	}
+	if err := recorder.Record(progress.Record{SQL: "INSERT INTO \n  a.b VALUES(2);", State: progress.StateCompleted}); err != nil {
+		t.Fatalf("unexpected failure %v", err)
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatalf("unexpected failure %v", err)
+	}
+	index, err := progress.LoadIndex(progressFilePath)
+	if err != nil {
+		t.Fatalf("unexpected failure %v", err)
+	}
+	if index.Len() != 2 {
+		t.Errorf("expected 2 queries in the index but had %v", index.Len())
+	}
+	for _, q := range []string{"INSERT INTO a.b VALUES(';');", "INSERT INTO \n  a.b VALUES(2);", "  INSERT INTO a.b VALUES(';')"} {
+		if !index.Contains(q) {
+			t.Errorf("expected index to contain %q", q)
+		}
+	}
+	if index.Contains("INSERT INTO a.b VALUES(3);") {
+		t.Error("expected index to not contain a query that was never completed")
+	}
+}
+
+func TestLoadIndexNoProgressFile(t *testing.T) {
+	index, err := progress.LoadIndex(filepath.Join(t.TempDir(), "progress.txt"))
+	if err != nil {
+		t.Fatalf("unexpected failure %v", err)
+	}
+	if index.Len() != 0 {
+		t.Errorf("expected an empty index but had %v", index.Len())
+	}
+}
+
+func TestJSONLJournal(t *testing.T) {
+	progressFilePath := filepath.Join(t.TempDir(), "progress.jsonl")
+
+	recorder, err := progress.OpenRecorder(progressFilePath, progress.FormatJSONL, false, progress.SyncPolicy{EveryRecords: 1})
+	if err != nil {
+		t.Fatalf("unexpected failure %v", err)
+	}
+	defer recorder.Close()
+	start := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := recorder.Record(progress.Record{
+		SQL:      "INSERT INTO a.b VALUES(1);",
+		File:     "queries.sql",
+		Line:     3,
+		Start:    start,
+		End:      start.Add(time.Second),
+		Attempts: 2,
+		State:    progress.StateCompleted,
+	}); err != nil {
+		t.Fatalf("unexpected failure %v", err)
+	}
+	if err := recorder.Record(progress.Record{
+		SQL:      "INSERT INTO a.b VALUES(2);",
+		Attempts: 2,
+		State:    progress.StateFailed,
+		Error:    "boom",
+	}); err != nil {
+		t.Fatalf("unexpected failure %v", err)
+	}
+
+	written, err := os.ReadFile(progressFilePath)
+	if err != nil {
+		t.Fatalf("unexpected failure reading file: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(written)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 records but had %q", lines)
+	}
+	var record progress.Record
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatalf("unexpected failure %v", err)
+	}
+	if record.Hash != progress.Hash("INSERT INTO a.b VALUES(1);") || record.Line != 3 || record.Attempts != 2 || !record.Start.Equal(start) {
+		t.Errorf("unexpected record %#v", record)
+	}
+
+	format, ok, err := progress.DetectFormat(progressFilePath)
+	if err != nil || !ok || format != progress.FormatJSONL {
+		t.Errorf("expected jsonl format but had %v %v %v", format, ok, err)
+	}
+	index, err := progress.LoadIndex(progressFilePath)
+	if err != nil {
+		t.Fatalf("unexpected failure %v", err)
+	}
+	if !index.Contains("INSERT INTO a.b VALUES(1);") {
+		t.Error("expected completed query to be in the index")
+	}
+	if index.Contains("INSERT INTO a.b VALUES(2);") {
+		t.Error("expected failed query to not be in the index")
+	}
+}
+
+func TestRecorderKeepsExistingFormat(t *testing.T) {
+	progressFilePath := filepath.Join(t.TempDir(), "progress.txt")
+	if err := os.WriteFile(progressFilePath, []byte("DROP TABLE A.B;\n"), 0600); err != nil {
+		t.Fatalf("unable to setup test %v", err)
+	}
+	recorder, err := progress.OpenRecorder(progressFilePath, progress.FormatJSONL, false, progress.SyncPolicy{})
+	if err != nil {
+		t.Fatalf("unexpected failure %v", err)
+	}
+	if recorder.Format() != progress.FormatText {
+		t.Fatalf("expected the text format of the existing file to be kept but had %v", recorder.Format())
+	}
+	if err := recorder.Record(progress.Record{SQL: "SELECT 1;", State: progress.StateCompleted}); err != nil {
+		t.Fatalf("unexpected failure %v", err)
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatalf("unexpected failure %v", err)
+	}
+	written, err := os.ReadFile(progressFilePath)
+	if err != nil {
+		t.Fatalf("unexpected failure reading file: %v", err)
+	}
+	expected := "DROP TABLE A.B;\nSELECT 1;\n"
+	if expected != string(written) {
+		t.Errorf("does not match expected\n%q\nactual\n%q", expected, string(written))
+	}
+}
+
+func TestRecorderTerminatesTrailingComment(t *testing.T) {
+	progressFilePath := filepath.Join(t.TempDir(), "progress.txt")
+	recorder, err := progress.OpenRecorder(progressFilePath, progress.FormatText, false, progress.SyncPolicy{})
+	if err != nil {
+		t.Fatalf("unexpected failure %v", err)
+	}
+	// a final statement accepted without a ';' can end in a line comment
+	queries := []string{"SELECT 3 -- note", "SELECT 4;"}
+	for _, q := range queries {
+		if err := recorder.Record(progress.Record{SQL: q, State: progress.StateCompleted}); err != nil {
+			t.Fatalf("unexpected failure %v", err)
+		}
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatalf("unexpected failure %v", err)
+	}
+	index, err := progress.LoadIndex(progressFilePath)
+	if err != nil {
+		t.Fatalf("unexpected failure %v", err)
+	}
+	if index.Len() != 2 {
+		t.Errorf("expected 2 queries in the index but had %v", index.Len())
+	}
+	for _, q := range queries {
+		if !index.Contains(q) {
+			t.Errorf("expected index to contain %q", q)
+		}
+	}
+}
+
+func TestLockIsExclusive(t *testing.T) {
+	progressFilePath := filepath.Join(t.TempDir(), "progress.txt")
+	lock, err := progress.AcquireLock(progressFilePath, false)
+	if err != nil {
+		t.Fatalf("unexpected failure %v", err)
+	}
+	_, err = progress.AcquireLock(progressFilePath, false)
+	var locked *progress.LockedError
+	if !errors.As(err, &locked) {
+		t.Fatalf("expected a LockedError but had %v", err)
+	}
+	if locked.Holder.PID != os.Getpid() {
+		t.Errorf("expected lock holder pid %v but had %v", os.Getpid(), locked.Holder.PID)
+	}
+	if err := lock.Release(); err != nil {
+		t.Fatalf("unexpected failure %v", err)
+	}
+	// the lock file is kept so every run locks the same file
+	info, err := os.Stat(progress.LockPath(progressFilePath))
+	if err != nil {
+		t.Fatalf("expected the lock file to be kept but had %v", err)
+	}
+	if info.Size() != 0 {
+		t.Errorf("expected the released lock file to be empty but it had %v bytes", info.Size())
+	}
+	lock, err = progress.AcquireLock(progressFilePath, false)
+	if err != nil {
+		t.Fatalf("expected lock to be available after release but had %v", err)
+	}
+	if err := lock.Release(); err != nil {
+		t.Fatalf("unexpected failure %v", err)
+	}
+}
+
+func TestStaleLock(t *testing.T) {
+	progressFilePath := filepath.Join(t.TempDir(), "progress.txt")
+	host, err := os.Hostname()
+	if err != nil {
+		t.Fatalf("unable to setup test %v", err)
+	}
+	// a pid above the maximum linux allows is never alive
+	writeLock := func(host string) {
+		info, err := json.Marshal(progress.LockInfo{PID: 1 << 23, Host: host, Started: time.Now()})
+		if err != nil {
+			t.Fatalf("unable to setup test %v", err)
+		}
+		if err := os.WriteFile(progress.LockPath(progressFilePath), info, 0600); err != nil {
+			t.Fatalf("unable to setup test %v", err)
+		}
+	}
+
+	writeLock(host)
+	lock, err := progress.AcquireLock(progressFilePath, false)
+	if err != nil {
+		t.Fatalf("expected stale lock from this host to be taken over but had %v", err)
+	}
+	if err := lock.Release(); err != nil {
+		t.Fatalf("unexpected failure %v", err)
+	}
+
+	writeLock("some-other-host")
+	if _, err := progress.AcquireLock(progressFilePath, false); err == nil {
+		t.Fatal("expected lock from another host to be refused")
+	}
+	lock, err = progress.AcquireLock(progressFilePath, true)
+	if err != nil {
+		t.Fatalf("expected forced unlock to succeed but had %v", err)
+	}
+	if err := lock.Release(); err != nil {
+		t.Fatalf("unexpected failure %v", err)
+	}
+}
+
+func TestRepairTornRecords(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   progress.Format
+		content  string
+		expected string
+	}{
+		{
+			name:     "text complete",
+			format:   progress.FormatText,
+			content:  "SELECT 1;\nSELECT 2;\n",
+			expected: "SELECT 1;\nSELECT 2;\n",
+		},
+		{
+			name:     "text missing newline",
+			format:   progress.FormatText,
+			content:  "SELECT 1;\nSELECT 2;",
+			expected: "SELECT 1;\nSELECT 2;\n",
+		},
+		{
+			name:     "text torn line",
+			format:   progress.FormatText,
+			content:  "SELECT 1;\nSELECT ';",
+			expected: "SELECT 1;\n",
+		},
+		{
+			name:     "text torn after newline",
+			format:   progress.FormatText,
+			content:  "SELECT 1;\nINSERT INTO a.b\n",
+			expected: "SELECT 1;\n",
+		},
+		{
+			name:     "jsonl torn line",
+			format:   progress.FormatJSONL,
+			content:  "{\"hash\":\"a\",\"state\":\"COMPLETED\"}\n{\"hash\":\"b\",\"sta",
+			expected: "{\"hash\":\"a\",\"state\":\"COMPLETED\"}\n",
+		},
+		{
+			name:     "jsonl missing newline",
+			format:   progress.FormatJSONL,
+			content:  "{\"hash\":\"a\",\"state\":\"COMPLETED\"}",
+			expected: "{\"hash\":\"a\",\"state\":\"COMPLETED\"}\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			progressFilePath := filepath.Join(t.TempDir(), "progress.txt")
+			if err := os.WriteFile(progressFilePath, []byte(tt.content), 0600); err != nil {
+				t.Fatalf("unable to setup test %v", err)
+			}
+			if err := progress.Repair(progressFilePath, tt.format); err != nil {
+				t.Fatalf("unexpected failure %v", err)
+			}
+			written, err := os.ReadFile(progressFilePath)
+			if err != nil {
+				t.Fatalf("unexpected failure reading file: %v", err)
+			}
+			if tt.expected != string(written) {
+				t.Errorf("does not match expected\n%q\nactual\n%q", tt.expected, string(written))
+			}
+		})
+	}
+}
+
+func TestRecorderSyncInterval(t *testing.T) {
+	progressFilePath := filepath.Join(t.TempDir(), "progress.txt")
+	recorder, err := progress.OpenRecorder(progressFilePath, progress.FormatText, false, progress.SyncPolicy{Interval: time.Millisecond})
+	if err != nil {
+		t.Fatalf("unexpected failure %v", err)
+	}
+	if err := recorder.Record(progress.Record{SQL: "SELECT 1", State: progress.StateCompleted}); err != nil {
+		t.Fatalf("unexpected failure %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if err := recorder.Close(); err != nil {
+		t.Fatalf("unexpected failure %v", err)
+	}
+	if err := recorder.Record(progress.Record{SQL: "SELECT 2;", State: progress.StateCompleted}); err == nil {
+		t.Error("expected an error recording to a closed progress file")
+	}
+	written, err := os.ReadFile(progressFilePath)
+	if err != nil {
+		t.Fatalf("unexpected failure reading file: %v", err)
+	}
+	if expected := "SELECT 1\n;\n"; expected != string(written) {
+		t.Errorf("does not match expected\n%q\nactual\n%q", expected, string(written))
+	}
+}
+
+func TestFailedWriter(t *testing.T) {
+	failedFilePath := filepath.Join(t.TempDir(), "failed.sql")
+	w, err := progress.CreateFailedWriter(failedFilePath)
+	if err != nil {
+		t.Fatalf("unexpected failure %v", err)
+	}
+	if err := w.Write(progress.Record{
+		SQL:      "INSERT INTO a.b VALUES(';');",
+		File:     "queries.sql",
+		Line:     4,
+		Attempts: 2,
+		JobID:    "1a2b",
+		Error:    "Table 'b' not found\nat line 1",
+	}); err != nil {
+		t.Fatalf("unexpected failure %v", err)
+	}
+	if err := w.Write(progress.Record{
+		SQL:      "SELECT 1 -- no terminator",
+		Attempts: 1,
+		Error:    "timeout",
+	}); err != nil {
+		t.Fatalf("unexpected failure %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("unexpected failure %v", err)
+	}
+	written, err := os.ReadFile(failedFilePath)
+	if err != nil {
+		t.Fatalf("unexpected failure reading file: %v", err)
+	}
+	expected := `-- source: queries.sql:4
+-- attempts: 2
+-- job: 1a2b
+-- error: Table 'b' not found
+--   at line 1
+INSERT INTO a.b VALUES(';');
+
+-- attempts: 1
+-- error: timeout
+SELECT 1 -- no terminator
+;
+
+`
+	if expected != string(written) {
+		t.Errorf("does not match expected\n%q\nactual\n%q", expected, string(written))
+	}
+	queries, err := parser.ReadQueries(failedFilePath, false)
+	if err != nil {
+		t.Fatalf("expected failed query file to be a valid source file but had %v", err)
+	}
+	if len(queries) != 2 {
+		t.Errorf("expected 2 queries in the failed query file but had %q", queries)
+	}
+}
@@ -0,0 +1,180 @@
+//	Copyright 2023 Dremio Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/conf"
+)
+
+// ways of authenticating with Dremio
+const (
+	AuthPassword      = "password"       // AuthPassword logs in with a user and password
+	AuthPAT           = "pat"            // AuthPAT uses a personal access token as a bearer token
+	AuthTokenExchange = "token-exchange" // AuthTokenExchange exchanges a JWT from an identity provider for a Dremio token
+)
+
+// ParseAuth validates the name of an authentication mode, a blank name is AuthPassword
+func ParseAuth(name string) (string, error) {
+	switch name {
+	case "":
+		return AuthPassword, nil
+	case AuthPassword, AuthPAT, AuthTokenExchange:
+		return name, nil
+	}
+	return "", fmt.Errorf("unsupported authentication '%v', use one of %v, %v or %v", name, AuthPassword, AuthPAT, AuthTokenExchange)
+}
+
+// LoadToken reads a token from the file, or when no file is given from the environment variable
+func LoadToken(file, envVar string) (string, error) {
+	var token string
+	switch {
+	case file != "":
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("unable to read token file: %w", err)
+		}
+		token = string(b)
+	case envVar != "":
+		token = os.Getenv(envVar)
+		if token == "" {
+			return "", fmt.Errorf("environment variable %v has no token", envVar)
+		}
+	default:
+		return "", errors.New("a token file or environment variable is required")
+	}
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return "", errors.New("blank token cannot proceed")
+	}
+	return token, nil
+}
+
+// authenticate returns the Authorization header to send with every request
+func authenticate(client http.Client, a conf.ProtocolArgs) (string, error) {
+	auth, err := ParseAuth(a.Auth)
+	if err != nil {
+		return "", err
+	}
+	switch auth {
+	case AuthPAT:
+		if a.Token == "" {
+			return "", errors.New("a personal access token is required")
+		}
+		return "Bearer " + a.Token, nil
+	case AuthTokenExchange:
+		token, err := exchangeToken(client, a)
+		if err != nil {
+			return "", err
+		}
+		return "Bearer " + token, nil
+	}
+	token, err := login(client, a)
+	if err != nil {
+		return "", err
+	}
+	return "_dremio" + token, nil
+}
+
+// canReauthenticate is true for the authentications that get a new token every time they log in
+func canReauthenticate(a conf.ProtocolArgs) bool {
+	auth, err := ParseAuth(a.Auth)
+	return err == nil && (auth == AuthPassword || auth == AuthTokenExchange)
+}
+
+// login authenticates with the user and password
+func login(client http.Client, a conf.ProtocolArgs) (string, error) {
+	jsonBody, err := json.Marshal(map[string]string{
+		"userName": a.User,
+		"password": a.Password,
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to create login json: %w", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%v/apiv2/login", a.URL), bytes.NewReader(jsonBody))
+	if err != nil {
+		return "", fmt.Errorf("unable to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resultMap, err := sendAuthRequest(client, req)
+	if err != nil {
+		return "", fmt.Errorf("unable to log in: %w", err)
+	}
+	return tokenFrom(resultMap, "token")
+}
+
+// exchangeToken trades a JWT from an identity provider for a Dremio access token with the OAuth token exchange flow
+func exchangeToken(client http.Client, a conf.ProtocolArgs) (string, error) {
+	if a.Token == "" {
+		return "", errors.New("a JWT to exchange is required")
+	}
+	form := url.Values{
+		"grant_type":         {"urn:ietf:params:oauth:grant-type:token-exchange"},
+		"subject_token":      {a.Token},
+		"subject_token_type": {"urn:ietf:params:oauth:token-type:jwt"},
+		"scope":              {"dremio.all"},
+	}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%v/oauth/token", a.URL), strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("unable to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resultMap, err := sendAuthRequest(client, req)
+	if err != nil {
+		return "", fmt.Errorf("unable to exchange token: %w", err)
+	}
+	return tokenFrom(resultMap, "access_token")
+}
+
+func sendAuthRequest(client http.Client, req *http.Request) (map[string]interface{}, error) {
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed sending request: %w", err)
+	}
+	defer res.Body.Close()
+	if err := checkStatus(res); err != nil {
+		return nil, err
+	}
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not read response body: %w", err)
+	}
+	var resultMap map[string]interface{}
+	if err := json.Unmarshal(resBody, &resultMap); err != nil {
+		return nil, fmt.Errorf("could not read json '%v' due to error '%w'", string(resBody), err)
+	}
+	return resultMap, nil
+}
+
+func tokenFrom(resultMap map[string]interface{}, key string) (string, error) {
+	v, ok := resultMap[key]
+	if !ok {
+		return "", fmt.Errorf("unable to read token from %#v", resultMap)
+	}
+	token := fmt.Sprintf("%v", v)
+	if token == "" {
+		return "", errors.New("blank token cannot proceed")
+	}
+	return token, nil
+}
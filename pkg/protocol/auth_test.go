@@ -0,0 +1,183 @@
+//	Copyright 2023 Dremio Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/conf"
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/protocol"
+)
+
+// authorizing only lets requests with the expected Authorization header through to the fake Dremio
+func authorizing(expected string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/oauth/token" {
+			if err := r.ParseForm(); err != nil || r.PostForm.Get("subject_token") != "idp-jwt" ||
+				r.PostForm.Get("grant_type") != "urn:ietf:params:oauth:grant-type:token-exchange" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			_, _ = w.Write([]byte(`{"access_token": "exchanged", "token_type": "Bearer", "expires_in": 3600}`))
+			return
+		}
+		if r.URL.Path != "/apiv2/login" && r.Header.Get("Authorization") != expected {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func TestAuth(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     conf.ProtocolArgs
+		expected string
+	}{
+		{name: "password", args: conf.ProtocolArgs{Auth: protocol.AuthPassword}, expected: "_dremioabc"},
+		{name: "default", args: conf.ProtocolArgs{}, expected: "_dremioabc"},
+		{name: "pat", args: conf.ProtocolArgs{Auth: protocol.AuthPAT, Token: "my-pat"}, expected: "Bearer my-pat"},
+		{name: "token exchange", args: conf.ProtocolArgs{Auth: protocol.AuthTokenExchange, Token: "idp-jwt"}, expected: "Bearer exchanged"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dremio := &fakeDremio{statuses: []string{`{"jobState": "COMPLETED"}`}}
+			tt.args.Timeout = 5 * time.Second
+			eng := newEngineWithArgs(t, authorizing(tt.expected, dremio), tt.args)
+			if _, err := eng.Execute(context.Background(), "SELECT 1"); err != nil {
+				t.Errorf("unexpected %v", err)
+			}
+		})
+	}
+}
+
+func TestParseAuth(t *testing.T) {
+	if _, err := protocol.ParseAuth("kerberos"); err == nil {
+		t.Error("expected an error for an unsupported authentication")
+	}
+}
+
+func TestLoadToken(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("from-file\n"), 0600); err != nil {
+		t.Fatalf("unable to setup test %v", err)
+	}
+	t.Setenv("TEST_DREMIO_TOKEN", "from-env")
+	token, err := protocol.LoadToken(tokenFile, "TEST_DREMIO_TOKEN")
+	if err != nil {
+		t.Fatalf("unexpected %v", err)
+	}
+	if token != "from-file" {
+		t.Errorf("expected the token file to win but had %q", token)
+	}
+	token, err = protocol.LoadToken("", "TEST_DREMIO_TOKEN")
+	if err != nil {
+		t.Fatalf("unexpected %v", err)
+	}
+	if token != "from-env" {
+		t.Errorf("expected the environment variable but had %q", token)
+	}
+	if _, err := protocol.LoadToken("", "TEST_DREMIO_TOKEN_MISSING"); err == nil {
+		t.Error("expected an error for a missing environment variable")
+	}
+}
+
+// expiringSession hands out a new token on every login and rejects every token but the latest one
+type expiringSession struct {
+	lock   sync.Mutex
+	logins int
+	next   http.Handler
+}
+
+func (e *expiringSession) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.lock.Lock()
+	if r.URL.Path == "/apiv2/login" {
+		e.logins++
+		fmt.Fprintf(w, `{"token": "t%v"}`, e.logins)
+		e.lock.Unlock()
+		return
+	}
+	valid := r.Header.Get("Authorization") == fmt.Sprintf("_dremiot%v", e.logins)
+	e.lock.Unlock()
+	if !valid {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	e.next.ServeHTTP(w, r)
+}
+
+func (e *expiringSession) expire() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.logins++
+}
+
+func TestReauthenticateWhenSessionExpires(t *testing.T) {
+	tests := []struct {
+		name              string
+		args              conf.ProtocolArgs
+		rejected          bool
+		reauthentications int
+	}{
+		{name: "password", args: conf.ProtocolArgs{Auth: protocol.AuthPassword}, reauthentications: 1},
+		// the personal access token never changes so it is not worth logging in again
+		{name: "pat", args: conf.ProtocolArgs{Auth: protocol.AuthPAT, Token: "my-pat"}, rejected: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := &expiringSession{next: &fakeDremio{statuses: []string{`{"jobState": "COMPLETED"}`}}}
+			tt.args.Timeout = 5 * time.Second
+			eng := newEngineWithArgs(t, session, tt.args)
+			session.expire()
+			logins := session.logins
+			wg := sync.WaitGroup{}
+			errs := make(chan error, 5)
+			for i := 0; i < 5; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					_, err := eng.Execute(context.Background(), "SELECT 1")
+					errs <- err
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				var statusErr *protocol.StatusError
+				switch {
+				case !tt.rejected && err != nil:
+					t.Errorf("unexpected %v", err)
+				case tt.rejected && (!errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusUnauthorized):
+					t.Errorf("expected the rejected status but had %v", err)
+				}
+			}
+			if eng.Reauthentications() != tt.reauthentications {
+				t.Errorf("expected %v logins for every thread but had %v", tt.reauthentications, eng.Reauthentications())
+			}
+			if tt.rejected && session.logins != logins {
+				t.Errorf("expected no logins but had %v", session.logins-logins)
+			}
+		})
+	}
+}
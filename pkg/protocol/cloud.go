@@ -0,0 +1,57 @@
+//	Copyright 2023 Dremio Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/conf"
+)
+
+// cloudRegions are the API urls of the Dremio Cloud control planes
+var cloudRegions = map[string]string{
+	"us": "https://api.dremio.cloud",
+	"eu": "https://api.eu.dremio.cloud",
+}
+
+// CloudURL returns the API url of a Dremio Cloud region, us or eu, a blank region is us. A full url is
+// returned as is so other deployments can be reached
+func CloudURL(region string) (string, error) {
+	if region == "" {
+		region = "us"
+	}
+	if strings.HasPrefix(region, "https://") || strings.HasPrefix(region, "http://") {
+		return strings.TrimSuffix(region, "/"), nil
+	}
+	u, ok := cloudRegions[region]
+	if !ok {
+		return "", fmt.Errorf("unknown Dremio Cloud region '%v', use us, eu or the API url", region)
+	}
+	return u, nil
+}
+
+// NewCloudEngine creates an engine for a Dremio Cloud project. The URL of the args is the API url of
+// the region, see CloudURL, and Dremio Cloud only accepts personal access tokens
+func NewCloudEngine(a conf.ProtocolArgs) (*HTTPProtocolEngine, error) {
+	if a.ProjectID == "" {
+		return &HTTPProtocolEngine{}, errors.New("a Dremio Cloud project id is required")
+	}
+	if a.Auth != AuthPAT {
+		return &HTTPProtocolEngine{}, fmt.Errorf("Dremio Cloud requires %v authentication", AuthPAT)
+	}
+	return newHTTPEngine(a, "Dremio Cloud", fmt.Sprintf("%v/v0/projects/%v", a.URL, a.ProjectID))
+}
@@ -0,0 +1,84 @@
+//	Copyright 2023 Dremio Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/conf"
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/protocol"
+)
+
+func TestCloudURL(t *testing.T) {
+	tests := []struct {
+		region   string
+		expected string
+	}{
+		{region: "", expected: "https://api.dremio.cloud"},
+		{region: "us", expected: "https://api.dremio.cloud"},
+		{region: "eu", expected: "https://api.eu.dremio.cloud"},
+		{region: "https://api.example.com/", expected: "https://api.example.com"},
+	}
+	for _, tt := range tests {
+		actual, err := protocol.CloudURL(tt.region)
+		if err != nil {
+			t.Fatalf("unexpected %v", err)
+		}
+		if actual != tt.expected {
+			t.Errorf("expected %v for region %q but had %v", tt.expected, tt.region, actual)
+		}
+	}
+	if _, err := protocol.CloudURL("mars"); err == nil {
+		t.Error("expected an error for an unknown region")
+	}
+}
+
+func TestCloudEngine(t *testing.T) {
+	dremio := &fakeDremio{apiPath: "/v0/projects/p1", statuses: []string{`{"jobState": "COMPLETED"}`}}
+	server := httptest.NewServer(authorizing("Bearer my-pat", dremio))
+	defer server.Close()
+	eng, err := protocol.NewCloudEngine(conf.ProtocolArgs{
+		Auth:      protocol.AuthPAT,
+		Token:     "my-pat",
+		URL:       server.URL,
+		ProjectID: "p1",
+		Timeout:   5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("unexpected %v", err)
+	}
+	result, err := eng.Execute(context.Background(), "SELECT 1")
+	if err != nil {
+		t.Fatalf("unexpected %v", err)
+	}
+	if result.JobID != "job1" {
+		t.Errorf("expected job1 but had %v", result.JobID)
+	}
+	if eng.Name() != "Dremio Cloud" {
+		t.Errorf("unexpected name %v", eng.Name())
+	}
+}
+
+func TestCloudEngineRequiresPAT(t *testing.T) {
+	if _, err := protocol.NewCloudEngine(conf.ProtocolArgs{ProjectID: "p1", User: "dremio", Password: "dremio123"}); err == nil {
+		t.Error("expected an error for password authentication")
+	}
+	if _, err := protocol.NewCloudEngine(conf.ProtocolArgs{Auth: protocol.AuthPAT, Token: "my-pat"}); err == nil {
+		t.Error("expected an error without a project id")
+	}
+}
@@ -0,0 +1,98 @@
+//	Copyright 2023 Dremio Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// StatusError is returned when Dremio answers a request with an HTTP status other than 2xx
+type StatusError struct {
+	StatusCode int
+	URL        string
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("request to %v failed with status %v: %v", e.URL, e.StatusCode, e.Body)
+}
+
+// JobError is returned when a job ends in a state other than COMPLETED
+type JobError struct {
+	JobID   string
+	State   string
+	Message string // Message is the error message Dremio reported for the job, if any
+}
+
+func (e *JobError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("failed with state of %v", e.State)
+	}
+	return fmt.Sprintf("failed with state of %v: %v", e.State, e.Message)
+}
+
+// TimeoutError is returned when a query runs longer than the query timeout
+type TimeoutError struct {
+	JobID    string
+	Timeout  time.Duration
+	State    string // State is the last state reported before the timeout
+	Canceled bool   // Canceled is true once the query is known to have stopped, so running it again cannot duplicate it
+}
+
+func (e *TimeoutError) Error() string {
+	if !e.Canceled {
+		return fmt.Sprintf("query timed out after %v. state was %v and the query could not be confirmed as canceled", e.Timeout, e.State)
+	}
+	return fmt.Sprintf("query timed out after %v. state was %v", e.Timeout, e.State)
+}
+
+// checkStatus returns a *StatusError for responses that are not 2xx, the body is consumed in that case
+func checkStatus(res *http.Response) error {
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return nil
+	}
+	const maxBody = 4096
+	body, _ := io.ReadAll(io.LimitReader(res.Body, maxBody))
+	return &StatusError{
+		StatusCode: res.StatusCode,
+		URL:        res.Request.URL.String(),
+		Body:       string(body),
+	}
+}
+
+// RPCError is returned when a Flight SQL call fails
+type RPCError struct {
+	Code    codes.Code
+	Message string
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Code, e.Message)
+}
+
+// flightError converts the gRPC status of an error into an *RPCError, other errors are returned as is
+func flightError(err error) error {
+	st, ok := status.FromError(err)
+	if !ok || st.Code() == codes.OK {
+		return err
+	}
+	return &RPCError{Code: st.Code(), Message: st.Message()}
+}
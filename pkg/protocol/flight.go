@@ -0,0 +1,306 @@
+//	Copyright 2023 Dremio Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/apache/arrow/go/v17/arrow"
+	"github.com/apache/arrow/go/v17/arrow/array"
+	"github.com/apache/arrow/go/v17/arrow/flight"
+	"github.com/apache/arrow/go/v17/arrow/flight/flightsql"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/conf"
+)
+
+// FlightProtocolEngine runs queries with Arrow Flight SQL, which Dremio serves on port 32010. Results are
+// streamed back on the same connection so there is no job status to poll, and ExecuteStreaming hands them
+// to the caller as they arrive
+type FlightProtocolEngine struct {
+	client        *flightsql.Client
+	authorization string
+	queryTimeout  time.Duration
+}
+
+// FlightAddress reads the address to dial from a url such as grpc://host:32010, grpc+tcp://host:32010
+// or grpc+tls://host:32010, useTLS is true for the last
+func FlightAddress(flightURL string) (addr string, useTLS bool, err error) {
+	u, err := url.Parse(flightURL)
+	if err != nil {
+		return "", false, fmt.Errorf("invalid Flight SQL url '%v': %w", flightURL, err)
+	}
+	switch u.Scheme {
+	case "grpc", "grpc+tcp":
+	case "grpc+tls":
+		useTLS = true
+	default:
+		return "", false, fmt.Errorf("invalid Flight SQL url '%v', use grpc://host:32010 or grpc+tls://host:32010", flightURL)
+	}
+	if u.Host == "" {
+		return "", false, fmt.Errorf("invalid Flight SQL url '%v', it has no host", flightURL)
+	}
+	return u.Host, useTLS, nil
+}
+
+// NewFlightEngine connects to the Flight SQL endpoint in the URL of the args, see FlightAddress, and authenticates
+// with either the user and password or a personal access token
+func NewFlightEngine(a conf.ProtocolArgs) (*FlightProtocolEngine, error) {
+	addr, useTLS, err := FlightAddress(a.URL)
+	if err != nil {
+		return &FlightProtocolEngine{}, err
+	}
+	creds := insecure.NewCredentials()
+	if useTLS {
+		config, err := newTLSConfig(a)
+		if err != nil {
+			return &FlightProtocolEngine{}, err
+		}
+		creds = credentials.NewTLS(config)
+	}
+	auth, err := ParseAuth(a.Auth)
+	if err != nil {
+		return &FlightProtocolEngine{}, err
+	}
+	if auth == AuthTokenExchange {
+		return &FlightProtocolEngine{}, fmt.Errorf("Flight SQL supports %v and %v authentication", AuthPassword, AuthPAT)
+	}
+	// Dremio keeps the session in a cookie
+	client, err := flightsql.NewClient(addr, nil, []flight.ClientMiddleware{flight.NewClientCookieMiddleware()}, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return &FlightProtocolEngine{}, fmt.Errorf("unable to create Flight SQL client: %w", err)
+	}
+	e := &FlightProtocolEngine{
+		client:       client,
+		queryTimeout: orDefault(a.Timeout, DefaultQueryTimeout),
+	}
+	if auth == AuthPAT {
+		if a.Token == "" {
+			client.Close()
+			return &FlightProtocolEngine{}, errors.New("a personal access token is required")
+		}
+		e.authorization = "Bearer " + a.Token
+		return e, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	authCtx, err := client.Client.AuthenticateBasicToken(ctx, a.User, a.Password)
+	if err != nil {
+		client.Close()
+		return &FlightProtocolEngine{}, fmt.Errorf("unable to log in: %w", flightError(err))
+	}
+	md, _ := metadata.FromOutgoingContext(authCtx)
+	if values := md.Get("authorization"); len(values) > 0 {
+		e.authorization = values[len(values)-1]
+	}
+	return e, nil
+}
+
+// Name of the protocol
+func (e *FlightProtocolEngine) Name() string {
+	return "Flight SQL"
+}
+
+// Execute runs the query and reads every row it returns, the row count of the result is the number of rows read
+func (e *FlightProtocolEngine) Execute(ctx context.Context, query string) (Result, error) {
+	return e.ExecuteStreaming(ctx, query, nil)
+}
+
+// ExecuteStreaming runs the query like Execute and hands every batch of rows to page as it is read, a result
+// without rows is a single page with only the schema
+func (e *FlightProtocolEngine) ExecuteStreaming(ctx context.Context, query string, page func(ResultPage) error) (Result, error) {
+	result := Result{}
+	queryCtx, cancel := context.WithTimeout(ctx, e.queryTimeout)
+	defer cancel()
+	if e.authorization != "" {
+		queryCtx = metadata.AppendToOutgoingContext(queryCtx, "authorization", e.authorization)
+	}
+	start := time.Now()
+	result.Start = &start
+	info, err := e.client.Execute(queryCtx, query)
+	if err != nil {
+		return e.failed(ctx, result, nil, err)
+	}
+	var rows int64
+	for _, endpoint := range info.GetEndpoint() {
+		n, err := e.read(queryCtx, endpoint.GetTicket(), page)
+		rows += n
+		if err != nil {
+			return e.failed(ctx, result, info, err)
+		}
+	}
+	end := time.Now()
+	result.End = &end
+	result.State = "COMPLETED"
+	result.RowCount = &rows
+	return result, nil
+}
+
+// read streams the rows of one endpoint to page, when it is not nil, and returns how many there were
+func (e *FlightProtocolEngine) read(ctx context.Context, ticket *flight.Ticket, page func(ResultPage) error) (int64, error) {
+	reader, err := e.client.DoGet(ctx, ticket)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Release()
+	var rows int64
+	for reader.Next() {
+		record := reader.Record()
+		rows += record.NumRows()
+		if page == nil {
+			continue
+		}
+		p, err := resultPage(record.Schema(), record)
+		if err != nil {
+			return rows, err
+		}
+		if err := page(p); err != nil {
+			return rows, err
+		}
+	}
+	if err := reader.Err(); err != nil {
+		return rows, err
+	}
+	if page != nil && rows == 0 {
+		p, err := resultPage(reader.Schema(), nil)
+		if err != nil {
+			return rows, err
+		}
+		return rows, page(p)
+	}
+	return rows, nil
+}
+
+// resultPage converts a batch of rows to a ResultPage, with the values encoded as the REST API encodes them.
+// A nil record gives a page with only the schema
+func resultPage(schema *arrow.Schema, record arrow.Record) (ResultPage, error) {
+	p := ResultPage{Schema: make([]Column, schema.NumFields())}
+	for i, field := range schema.Fields() {
+		p.Schema[i] = Column{Name: field.Name, Type: dremioType(field.Type)}
+	}
+	if record == nil {
+		return p, nil
+	}
+	p.Rows = make([]map[string]json.RawMessage, record.NumRows())
+	for r := range p.Rows {
+		p.Rows[r] = make(map[string]json.RawMessage, len(p.Schema))
+	}
+	for c, col := range record.Columns() {
+		for r := range p.Rows {
+			v, err := jsonValue(col, r)
+			if err != nil {
+				return p, fmt.Errorf("invalid value for column %v: %w", p.Schema[c].Name, err)
+			}
+			p.Rows[r][p.Schema[c].Name] = v
+		}
+	}
+	return p, nil
+}
+
+// jsonValue encodes one value of the column, timestamps are formatted the way Dremio formats them
+func jsonValue(col arrow.Array, i int) (json.RawMessage, error) {
+	if col.IsNull(i) {
+		return json.RawMessage("null"), nil
+	}
+	if ts, ok := col.(*array.Timestamp); ok {
+		toTime, err := ts.DataType().(*arrow.TimestampType).GetToTimeFunc()
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(toTime(ts.Value(i)).UTC().Format("2006-01-02 15:04:05.000"))
+	}
+	return json.Marshal(col.GetOneForMarshal(i))
+}
+
+// dremioType is the name Dremio gives the Arrow type
+func dremioType(t arrow.DataType) string {
+	switch t.ID() {
+	case arrow.BOOL:
+		return "BOOLEAN"
+	case arrow.INT8, arrow.INT16, arrow.INT32, arrow.UINT8, arrow.UINT16:
+		return "INTEGER"
+	case arrow.INT64, arrow.UINT32, arrow.UINT64:
+		return "BIGINT"
+	case arrow.FLOAT16, arrow.FLOAT32:
+		return "FLOAT"
+	case arrow.FLOAT64:
+		return "DOUBLE"
+	case arrow.DATE32, arrow.DATE64:
+		return "DATE"
+	case arrow.TIMESTAMP:
+		return "TIMESTAMP"
+	case arrow.DECIMAL128, arrow.DECIMAL256:
+		return "DECIMAL"
+	case arrow.STRING, arrow.LARGE_STRING:
+		return "VARCHAR"
+	case arrow.BINARY, arrow.LARGE_BINARY, arrow.FIXED_SIZE_BINARY:
+		return "VARBINARY"
+	}
+	return strings.ToUpper(t.Name())
+}
+
+// failed describes a query that did not complete, when the caller gave up on it the query is canceled
+func (e *FlightProtocolEngine) failed(ctx context.Context, result Result, info *flight.FlightInfo, err error) (Result, error) {
+	end := time.Now()
+	result.End = &end
+	result.State = "FAILED"
+	if ctx.Err() != nil || errors.Is(err, context.DeadlineExceeded) || status.Code(err) == codes.DeadlineExceeded {
+		result.State = "CANCELED"
+		canceled := info != nil && e.cancel(info)
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+		return result, &TimeoutError{Timeout: e.queryTimeout, State: "RUNNING", Canceled: canceled}
+	}
+	err = flightError(err)
+	result.ErrorMessage = err.Error()
+	return result, err
+}
+
+// cancel asks the server to stop a query the caller gave up on and is true once the server reports
+// it as canceled, not every server supports it
+func (e *FlightProtocolEngine) cancel(info *flight.FlightInfo) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if e.authorization != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", e.authorization)
+	}
+	res, err := e.client.CancelFlightInfo(ctx, &flight.CancelFlightInfoRequest{Info: info})
+	if err != nil {
+		log.Printf("WARN: unable to cancel Flight SQL query: %v", flightError(err))
+		return false
+	}
+	return res.GetStatus() == flight.CancelStatusCancelled
+}
+
+// Close closes the connection to the server
+func (e *FlightProtocolEngine) Close() error {
+	if e.client == nil {
+		return nil
+	}
+	return e.client.Close()
+}
@@ -0,0 +1,290 @@
+//	Copyright 2023 Dremio Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apache/arrow/go/v17/arrow"
+	"github.com/apache/arrow/go/v17/arrow/array"
+	"github.com/apache/arrow/go/v17/arrow/flight"
+	"github.com/apache/arrow/go/v17/arrow/flight/flightsql"
+	"github.com/apache/arrow/go/v17/arrow/memory"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/conf"
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/protocol"
+)
+
+// fakeFlightSQL stands in for the Flight SQL endpoint of Dremio. Queries that do not start with SELECT fail
+// to parse, "SELECT wait" runs until the client gives up and any other query returns 2 batches of 3 rows
+type fakeFlightSQL struct {
+	flightsql.BaseServer
+	lock     sync.Mutex
+	canceled int
+}
+
+func (f *fakeFlightSQL) GetFlightInfoStatement(_ context.Context, q flightsql.StatementQuery, desc *flight.FlightDescriptor) (*flight.FlightInfo, error) {
+	if !strings.HasPrefix(q.GetQuery(), "SELECT") {
+		return nil, status.Error(codes.InvalidArgument, "PARSE ERROR: Failure parsing the query.")
+	}
+	ticket, err := flightsql.CreateStatementQueryTicket([]byte(q.GetQuery()))
+	if err != nil {
+		return nil, err
+	}
+	return &flight.FlightInfo{
+		FlightDescriptor: desc,
+		Endpoint:         []*flight.FlightEndpoint{{Ticket: &flight.Ticket{Ticket: ticket}}},
+		TotalRecords:     -1,
+		TotalBytes:       -1,
+	}, nil
+}
+
+func (f *fakeFlightSQL) DoGetStatement(ctx context.Context, ticket flightsql.StatementQueryTicket) (*arrow.Schema, <-chan flight.StreamChunk, error) {
+	schema := arrow.NewSchema([]arrow.Field{{Name: "n", Type: arrow.PrimitiveTypes.Int64}}, nil)
+	chunks := make(chan flight.StreamChunk)
+	go func() {
+		defer close(chunks)
+		if string(ticket.GetStatementHandle()) == "SELECT wait" {
+			<-ctx.Done()
+			return
+		}
+		for i := 0; i < 2; i++ {
+			b := array.NewInt64Builder(memory.DefaultAllocator)
+			b.AppendValues([]int64{1, 2, 3}, nil)
+			col := b.NewArray()
+			b.Release()
+			chunks <- flight.StreamChunk{Data: array.NewRecord(schema, []arrow.Array{col}, 3)}
+			col.Release()
+		}
+	}()
+	return schema, chunks, nil
+}
+
+func (f *fakeFlightSQL) CancelFlightInfo(context.Context, *flight.CancelFlightInfoRequest) (flight.CancelFlightInfoResult, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.canceled++
+	return flight.CancelFlightInfoResult{Status: flight.CancelStatusCancelled}, nil
+}
+
+func (f *fakeFlightSQL) Canceled() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.canceled
+}
+
+// flightAuth accepts dremio/dremio123 and the tokens it hands out as well as the personal access token "pat"
+type flightAuth struct{}
+
+func (flightAuth) Validate(user, pass string) (string, error) {
+	if user == "dremio" && pass == "dremio123" {
+		return "session", nil
+	}
+	return "", status.Error(codes.Unauthenticated, "invalid user or password")
+}
+
+func (flightAuth) IsValid(token string) (interface{}, error) {
+	if token == "session" || token == "pat" {
+		return token, nil
+	}
+	return nil, status.Error(codes.Unauthenticated, "invalid token")
+}
+
+// newFlightServer starts a fake Flight SQL server and returns it with its grpc url
+func newFlightServer(t *testing.T) (*fakeFlightSQL, string) {
+	t.Helper()
+	fake := &fakeFlightSQL{}
+	server := flight.NewServerWithMiddleware([]flight.ServerMiddleware{flight.CreateServerBasicAuthMiddleware(flightAuth{})})
+	server.RegisterFlightService(flightsql.NewFlightServer(fake))
+	if err := server.Init("localhost:0"); err != nil {
+		t.Fatalf("unable to start Flight SQL server: %v", err)
+	}
+	go func() {
+		_ = server.Serve()
+	}()
+	t.Cleanup(server.Shutdown)
+	return fake, "grpc://" + server.Addr().String()
+}
+
+func newFlightEngine(t *testing.T, args conf.ProtocolArgs) *protocol.FlightProtocolEngine {
+	t.Helper()
+	eng, err := protocol.NewFlightEngine(args)
+	if err != nil {
+		t.Fatalf("unable to create engine: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := eng.Close(); err != nil {
+			t.Errorf("unable to close engine: %v", err)
+		}
+	})
+	return eng
+}
+
+func TestFlightAddress(t *testing.T) {
+	tests := []struct {
+		url    string
+		addr   string
+		useTLS bool
+		err    bool
+	}{
+		{url: "grpc://localhost:32010", addr: "localhost:32010"},
+		{url: "grpc+tcp://localhost:32010", addr: "localhost:32010"},
+		{url: "grpc+tls://dremio.example.com:32010", addr: "dremio.example.com:32010", useTLS: true},
+		{url: "http://localhost:9047", err: true},
+		{url: "grpc://", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			addr, useTLS, err := protocol.FlightAddress(tt.url)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected an error for %v", tt.url)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if addr != tt.addr || useTLS != tt.useTLS {
+				t.Errorf("expected %v tls %v but was %v tls %v", tt.addr, tt.useTLS, addr, useTLS)
+			}
+		})
+	}
+}
+
+func TestFlightExecute(t *testing.T) {
+	_, url := newFlightServer(t)
+	for _, args := range []conf.ProtocolArgs{
+		{URL: url, Auth: protocol.AuthPassword, User: "dremio", Password: "dremio123"},
+		{URL: url, Auth: protocol.AuthPAT, Token: "pat"},
+	} {
+		t.Run(args.Auth, func(t *testing.T) {
+			eng := newFlightEngine(t, args)
+			result, err := eng.Execute(context.Background(), "SELECT n FROM t")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result.State != "COMPLETED" {
+				t.Errorf("expected state COMPLETED but was %v", result.State)
+			}
+			if result.RowCount == nil || *result.RowCount != 6 {
+				t.Errorf("expected 6 rows but was %v", result.RowCount)
+			}
+			if result.Start == nil || result.End == nil {
+				t.Errorf("expected start and end times but were %v and %v", result.Start, result.End)
+			}
+		})
+	}
+}
+
+func TestFlightExecuteStreaming(t *testing.T) {
+	_, url := newFlightServer(t)
+	eng := newFlightEngine(t, conf.ProtocolArgs{URL: url, Auth: protocol.AuthPAT, Token: "pat"})
+	var pages []protocol.ResultPage
+	result, err := eng.ExecuteStreaming(context.Background(), "SELECT n FROM t", func(page protocol.ResultPage) error {
+		pages = append(pages, page)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.RowCount == nil || *result.RowCount != 6 {
+		t.Errorf("expected 6 rows but was %v", result.RowCount)
+	}
+	if len(pages) != 2 {
+		t.Fatalf("expected a page for each of the 2 batches but had %v", len(pages))
+	}
+	expectedSchema := []protocol.Column{{Name: "n", Type: "BIGINT"}}
+	if !reflect.DeepEqual(expectedSchema, pages[0].Schema) {
+		t.Errorf("expected schema %v but was %v", expectedSchema, pages[0].Schema)
+	}
+	var values []string
+	for _, page := range pages {
+		for _, row := range page.Rows {
+			values = append(values, string(row["n"]))
+		}
+	}
+	expected := []string{"1", "2", "3", "1", "2", "3"}
+	if !reflect.DeepEqual(expected, values) {
+		t.Errorf("expected values %v but was %v", expected, values)
+	}
+}
+
+func TestFlightAuthFailure(t *testing.T) {
+	_, url := newFlightServer(t)
+	if _, err := protocol.NewFlightEngine(conf.ProtocolArgs{URL: url, User: "dremio", Password: "wrong"}); err == nil {
+		t.Error("expected the login to fail")
+	}
+	eng := newFlightEngine(t, conf.ProtocolArgs{URL: url, Auth: protocol.AuthPAT, Token: "expired"})
+	_, err := eng.Execute(context.Background(), "SELECT 1")
+	var rpcErr *protocol.RPCError
+	if !errors.As(err, &rpcErr) || rpcErr.Code != codes.Unauthenticated {
+		t.Errorf("expected an Unauthenticated RPCError but was %v", err)
+	}
+}
+
+func TestFlightExecuteError(t *testing.T) {
+	_, url := newFlightServer(t)
+	eng := newFlightEngine(t, conf.ProtocolArgs{URL: url, User: "dremio", Password: "dremio123"})
+	result, err := eng.Execute(context.Background(), "SELEC 1")
+	var rpcErr *protocol.RPCError
+	if !errors.As(err, &rpcErr) {
+		t.Fatalf("expected an RPCError but was %v", err)
+	}
+	if rpcErr.Code != codes.InvalidArgument || !strings.Contains(rpcErr.Message, "PARSE ERROR") {
+		t.Errorf("unexpected error %v", rpcErr)
+	}
+	if result.State != "FAILED" || result.ErrorMessage != err.Error() {
+		t.Errorf("expected a FAILED result with the error but was %v: %v", result.State, result.ErrorMessage)
+	}
+}
+
+func TestFlightExecuteCanceledByContext(t *testing.T) {
+	fake, url := newFlightServer(t)
+	eng := newFlightEngine(t, conf.ProtocolArgs{URL: url, User: "dremio", Password: "dremio123"})
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	result, err := eng.Execute(ctx, "SELECT wait")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the context error but was %v", err)
+	}
+	if result.State != "CANCELED" {
+		t.Errorf("expected state CANCELED but was %v", result.State)
+	}
+	if fake.Canceled() != 1 {
+		t.Errorf("expected the query to be canceled once but was %v", fake.Canceled())
+	}
+}
+
+func TestFlightExecuteTimeout(t *testing.T) {
+	fake, url := newFlightServer(t)
+	eng := newFlightEngine(t, conf.ProtocolArgs{URL: url, User: "dremio", Password: "dremio123", Timeout: 200 * time.Millisecond})
+	_, err := eng.Execute(context.Background(), "SELECT wait")
+	var timeoutErr *protocol.TimeoutError
+	if !errors.As(err, &timeoutErr) || !timeoutErr.Canceled {
+		t.Fatalf("expected a timeout of a canceled query but was %v", err)
+	}
+	if fake.Canceled() != 1 {
+		t.Errorf("expected the query to be canceled once but was %v", fake.Canceled())
+	}
+}
@@ -16,11 +16,14 @@ package protocol
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/rsvihladremio/dremio-batch-execute/pkg/conf"
@@ -28,26 +31,55 @@ import (
 
 // Engine provides the interface for making remote calls to dremio via a given protocol
 type Engine interface {
-	Execute(string) error
+	// Execute runs the query and waits for it to finish. When the context is done before the query
+	// finishes the engine stops waiting and cancels the query if it can
+	Execute(ctx context.Context, query string) (Result, error)
 	Name() string
 }
 
+// Result describes how a query ran
+type Result struct {
+	JobID        string // JobID identifies the query in Dremio, blank when it was never submitted
+	State        string // State is the final state of the job, such as COMPLETED or FAILED
+	ErrorMessage string // ErrorMessage is the error Dremio reported for the job, if any
+	RowCount     *int64 // RowCount is the number of rows the job returned or changed, nil when not reported
+	// Start and End bound the whole job. The job plans its query between Start and QueueStart, waits
+	// for resources until QueueEnd and then executes until End. Each is nil when not reported
+	Start       *time.Time
+	QueueStart  *time.Time
+	QueueEnd    *time.Time
+	End         *time.Time
+	Accelerated bool // Accelerated is true when a reflection was used to run the query
+}
+
+// Reauthenticator is implemented by engines that log in again when their session expires
+type Reauthenticator interface {
+	Reauthentications() int
+}
+
 // HTTPProtocolEngine uses HTTP calls against the Dremio REST API
 type HTTPProtocolEngine struct {
-	token               string
-	client              http.Client
-	queryTimeoutMinutes int
-	queryURL            string
-	sourceURL           string
-	queryStatusURL      string
+	name              string
+	args              conf.ProtocolArgs
+	authLock          sync.Mutex
+	token             string
+	reauthentications int
+	client            http.Client
+	queryTimeout      time.Duration
+	pollInterval      time.Duration
+	maxPollInterval   time.Duration
+	cancelTimeout     time.Duration
+	queryURL          string
+	sourceURL         string
+	queryStatusURL    string
 }
 
 // Name of the protocol
 func (h *HTTPProtocolEngine) Name() string {
-	return "HTTP"
+	return h.name
 }
 
-func (h *HTTPProtocolEngine) MakeSource(sourceName string) error {
+func (h *HTTPProtocolEngine) MakeSource(ctx context.Context, sourceName string) error {
 	jsonBody := fmt.Sprintf(`{
 		"metadataPolicy": {       
 			"authTTLMs":86400000,
@@ -64,192 +96,333 @@ func (h *HTTPProtocolEngine) MakeSource(sourceName string) error {
 		"name": "%v"
 	}
 `, sourceName)
-	req, err := http.NewRequest(http.MethodPost, h.sourceURL, bytes.NewBuffer([]byte(jsonBody)))
+	_, err := h.submit(ctx, h.sourceURL, []byte(jsonBody))
+	return err
+}
+
+// Execute submits the query to the SQL API and polls the job until it finishes
+func (h *HTTPProtocolEngine) Execute(ctx context.Context, query string) (Result, error) {
+	return h.ExecuteQuery(ctx, Query{SQL: query})
+}
+
+// sqlRequest is the body of a submission to the SQL API
+type sqlRequest struct {
+	SQL        string               `json:"sql"`
+	Context    []string             `json:"context,omitempty"`
+	References map[string]Reference `json:"references,omitempty"`
+}
+
+// ExecuteQuery submits the query with its context and references to the SQL API and polls the job until it finishes
+func (h *HTTPProtocolEngine) ExecuteQuery(ctx context.Context, q Query) (Result, error) {
+	jsonBody, err := json.Marshal(sqlRequest{
+		SQL:        q.SQL,
+		Context:    q.Context,
+		References: q.References,
+	})
 	if err != nil {
-		return fmt.Errorf("unable to create request %w", err)
+		return Result{}, fmt.Errorf("unable to create sql json: %w", err)
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", h.token)
+	return h.submit(ctx, h.queryURL, jsonBody)
+}
 
-	res, err := h.client.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed sending login request: %w", err)
+// submit posts the body to the url and waits for the job it starts to finish
+func (h *HTTPProtocolEngine) submit(ctx context.Context, url string, jsonBody []byte) (Result, error) {
+	var resultMap map[string]interface{}
+	if err := h.do(ctx, http.MethodPost, url, jsonBody, &resultMap); err != nil {
+		return Result{}, err
 	}
-	resBody, err := io.ReadAll(res.Body)
-	if err != nil {
-		return fmt.Errorf("could not read response body: %w", err)
+	v, ok := resultMap["id"]
+	if !ok {
+		return Result{}, fmt.Errorf("no job id in response %#v so failing the query", resultMap)
+	}
+	token := fmt.Sprintf("%v", v)
+	if token == "" {
+		return Result{}, errors.New("blank id cannot proceed")
+	}
+	result := Result{JobID: token}
+	status, err := h.checkQueryStatus(ctx, token, h.queryTimeout, finalStates)
+	var timeoutErr *TimeoutError
+	if errors.As(err, &timeoutErr) {
+		status, err = h.cancelTimedOut(ctx, token, status, timeoutErr)
+	}
+	status.apply(&result)
+	if err != nil && ctx.Err() != nil {
+		h.cancelJob(token)
+		return result, err
 	}
-	var resultMap map[string]interface{}
-	err = json.Unmarshal(resBody, &resultMap)
 	if err != nil {
-		return fmt.Errorf("could not read %v json %w", string(resBody), err)
+		return result, err
+	}
+	if result.State != "COMPLETED" {
+		return result, &JobError{JobID: token, State: result.State, Message: result.ErrorMessage}
+	}
+	return result, nil
+}
+
+// cancelJob asks Dremio to cancel a job the caller stopped waiting on. The caller's context is
+// already done so the request gets its own short deadline
+func (h *HTTPProtocolEngine) cancelJob(id string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := h.do(ctx, http.MethodPost, fmt.Sprintf("%v/%v/cancel", h.queryStatusURL, id), nil, nil); err != nil {
+		log.Printf("WARN: unable to cancel job %v: %v", id, err)
 	}
+}
 
-	v, ok := resultMap["id"]
-	if ok {
-		token := fmt.Sprintf("%v", v)
-		if token == "" {
-			return errors.New("blank id cannot proceed")
-		}
-		// TODO: add stats on job status at some point
-		lastState, err := h.checkQueryStatus(fmt.Sprintf("%v", v))
-		if err != nil {
-			return err
-		}
-		if lastState != "COMPLETED" {
-			return fmt.Errorf("failed with state of %v", lastState)
+// cancelTimedOut cancels a job that ran past the query timeout and waits for Dremio to report it as stopped,
+// so that another attempt of the query never runs next to it. A job that completed before the cancel took
+// effect is returned without an error
+func (h *HTTPProtocolEngine) cancelTimedOut(ctx context.Context, id string, status jobStatus, timeoutErr *TimeoutError) (jobStatus, error) {
+	log.Printf("job %v timed out after %v, canceling it", id, h.queryTimeout)
+	if err := h.do(ctx, http.MethodPost, fmt.Sprintf("%v/%v/cancel", h.queryStatusURL, id), nil, nil); err != nil {
+		// the job may have finished in the meantime, the state it reports decides
+		log.Printf("WARN: unable to cancel job %v: %v", id, err)
+	}
+	next, err := h.checkQueryStatus(ctx, id, h.cancelTimeout, stoppedStates)
+	if next.JobState == "" {
+		next = status
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return next, err
 		}
-		return nil
+		log.Printf("WARN: job %v was not canceled within %v, its state is %v so the query will not be attempted again", id, h.cancelTimeout, next.JobState)
+		return next, timeoutErr
 	}
-	return fmt.Errorf("no job id in response %#v so failing the query", resultMap)
+	if next.JobState == "COMPLETED" {
+		return next, nil
+	}
+	timeoutErr.Canceled = true
+	return next, timeoutErr
 }
 
-func (h *HTTPProtocolEngine) Execute(query string) error {
-	data := map[string]string{
-		"sql": query,
+// do sends a request to the REST API and decodes the JSON response into result, unless result is nil.
+// When the session has expired and the authentication can get a new token it logs in again once and
+// replays the request
+func (h *HTTPProtocolEngine) do(ctx context.Context, method, url string, body []byte, result interface{}) error {
+	token := h.authorization()
+	err := h.send(ctx, method, url, body, token, result)
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || (statusErr.StatusCode != http.StatusUnauthorized && statusErr.StatusCode != http.StatusForbidden) {
+		return err
 	}
-	jsonBody, err := json.Marshal(data)
-	if err != nil {
-		return fmt.Errorf("unable to create sql json: %w", err)
+	if !canReauthenticate(h.args) {
+		// a personal access token stays the same so logging in again cannot help
+		return err
+	}
+	if authErr := h.reauthenticate(token); authErr != nil {
+		return fmt.Errorf("%w, logging in again failed: %v", err, authErr)
 	}
-	req, err := http.NewRequest(http.MethodPost, h.queryURL, bytes.NewBuffer(jsonBody))
+	return h.send(ctx, method, url, body, h.authorization(), result)
+}
+
+func (h *HTTPProtocolEngine) send(ctx context.Context, method, url string, body []byte, token string, result interface{}) error {
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, bodyReader)
 	if err != nil {
 		return fmt.Errorf("unable to create request %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", h.token)
+	req.Header.Set("Authorization", token)
 
 	res, err := h.client.Do(req)
 	if err != nil {
-		return fmt.Errorf("failed sending login request: %w", err)
+		return fmt.Errorf("failed sending request: %w", err)
+	}
+	defer res.Body.Close()
+	if err := checkStatus(res); err != nil {
+		return err
 	}
 	resBody, err := io.ReadAll(res.Body)
 	if err != nil {
 		return fmt.Errorf("could not read response body: %w", err)
 	}
-	var resultMap map[string]interface{}
-	err = json.Unmarshal(resBody, &resultMap)
-	if err != nil {
+	if result == nil {
+		return nil
+	}
+	if err := json.Unmarshal(resBody, result); err != nil {
 		return fmt.Errorf("could not read %v json %w", string(resBody), err)
 	}
+	return nil
+}
 
-	v, ok := resultMap["id"]
-	if ok {
-		token := fmt.Sprintf("%v", v)
-		if token == "" {
-			return errors.New("blank id cannot proceed")
-		}
-		// TODO: add stats on job status at some point
-		lastState, err := h.checkQueryStatus(fmt.Sprintf("%v", v))
-		if err != nil {
-			return err
-		}
-		if lastState != "COMPLETED" {
-			return fmt.Errorf("failed with state of %v", lastState)
+func (h *HTTPProtocolEngine) authorization() string {
+	h.authLock.Lock()
+	defer h.authLock.Unlock()
+	return h.token
+}
+
+// reauthenticate logs in again unless another thread already replaced the rejected token, so
+// every thread that sees the session expire at once causes a single login
+func (h *HTTPProtocolEngine) reauthenticate(rejected string) error {
+	h.authLock.Lock()
+	defer h.authLock.Unlock()
+	if h.token != rejected {
+		return nil
+	}
+	token, err := authenticate(h.client, h.args)
+	if err != nil {
+		return err
+	}
+	if token == rejected {
+		return errors.New("the new login returned the token that was rejected")
+	}
+	h.token = token
+	h.reauthentications++
+	log.Printf("the session with Dremio was rejected, logged in again")
+	return nil
+}
+
+// Reauthentications is how many times the engine had to log in again because its session was rejected
+func (h *HTTPProtocolEngine) Reauthentications() int {
+	h.authLock.Lock()
+	defer h.authLock.Unlock()
+	return h.reauthentications
+}
+
+// jobStatus is the response of the job status API
+type jobStatus struct {
+	JobState                    string `json:"jobState"`
+	RowCount                    *int64 `json:"rowCount"`
+	ErrorMessage                string `json:"errorMessage"`
+	StartedAt                   string `json:"startedAt"`
+	EndedAt                     string `json:"endedAt"`
+	ResourceSchedulingStartedAt string `json:"resourceSchedulingStartedAt"`
+	ResourceSchedulingEndedAt   string `json:"resourceSchedulingEndedAt"`
+	Acceleration                *struct {
+		ReflectionRelationships []struct {
+			Relationship string `json:"relationship"`
+		} `json:"reflectionRelationships"`
+	} `json:"acceleration"`
+}
+
+// apply copies the details of the job into the result
+func (s jobStatus) apply(result *Result) {
+	result.State = s.JobState
+	result.ErrorMessage = s.ErrorMessage
+	result.RowCount = s.RowCount
+	result.Start = parseTime(s.StartedAt)
+	result.QueueStart = parseTime(s.ResourceSchedulingStartedAt)
+	result.QueueEnd = parseTime(s.ResourceSchedulingEndedAt)
+	result.End = parseTime(s.EndedAt)
+	if s.Acceleration != nil {
+		for _, r := range s.Acceleration.ReflectionRelationships {
+			if r.Relationship == "CHOSEN" {
+				result.Accelerated = true
+			}
 		}
+	}
+}
+
+// parseTime reads a timestamp of the job status API, it is nil when missing or not understood
+func parseTime(s string) *time.Time {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
 		return nil
 	}
-	return fmt.Errorf("no job id in response %#v so failing the query", resultMap)
+	return &t
 }
 
-func (h *HTTPProtocolEngine) checkQueryStatus(id string) (status string, err error) {
+// finalStates end the wait for a job, stoppedStates are the final states in which it no longer runs
+var (
+	finalStates   = map[string]bool{"COMPLETED": true, "CANCELED": true, "FAILED": true, "INVALID_STATE": true, "CANCELLATION_REQUESTED": true}
+	stoppedStates = map[string]bool{"COMPLETED": true, "CANCELED": true, "FAILED": true}
+)
+
+// checkQueryStatus polls the job until it reaches one of the states in until, or the timeout passes, and returns
+// the last status Dremio reported. The first poll comes after the poll interval which then doubles up to the max
+// poll interval, so short queries finish quickly while long ones are not polled more than needed
+func (h *HTTPProtocolEngine) checkQueryStatus(ctx context.Context, id string, timeout time.Duration, until map[string]bool) (jobStatus, error) {
 	url := fmt.Sprintf("%v/%v", h.queryStatusURL, id)
-	intervalsPerMinutes := 6
-	sleepTimeSeconds := 60 / intervalsPerMinutes
-	totalIterations := h.queryTimeoutMinutes * intervalsPerMinutes
-	var lastState string
-	for i := 0; i < totalIterations; i++ {
-		time.Sleep(time.Duration(sleepTimeSeconds) * time.Second)
-		req, err := http.NewRequest(http.MethodGet, url, nil)
-		if err != nil {
-			return "", fmt.Errorf("unable to create request %w", err)
+	pollCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	interval := h.pollInterval
+	var status jobStatus
+	for {
+		var next jobStatus
+		err := sleep(pollCtx, interval)
+		if err == nil {
+			err = h.do(pollCtx, http.MethodGet, url, nil, &next)
 		}
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("Authorization", h.token)
-
-		res, err := h.client.Do(req)
 		if err != nil {
-			return "", fmt.Errorf("failed sending login request: %w", err)
+			if ctx.Err() == nil && pollCtx.Err() != nil {
+				return status, &TimeoutError{JobID: id, Timeout: timeout, State: status.JobState}
+			}
+			return status, err
 		}
-		resBody, err := io.ReadAll(res.Body)
-		if err != nil {
-			return "", fmt.Errorf("client: could not read response body: %s", err)
+		interval = min(interval*2, h.maxPollInterval)
+		if next.JobState == "" {
+			return status, fmt.Errorf("invalid result body for id %v: no jobState", id)
 		}
-		var resultMap map[string]interface{}
-		err = json.Unmarshal(resBody, &resultMap)
-		if err != nil {
-			return "", fmt.Errorf("client: could not read json: %s", err)
+		status = next
+		// possible results
+		//"NOT_SUBMITTED, STARTING, RUNNING, COMPLETED, CANCELED, FAILED, CANCELLATION_REQUESTED, PLANNING, PENDING, METADATA_RETRIEVAL, QUEUED, ENGINE_START, EXECUTION_PLANNING, INVALID_STATE
+		if until[status.JobState] {
+			return status, nil
 		}
+	}
+}
 
-		if jobState, ok := resultMap["jobState"]; ok {
-			v := fmt.Sprintf("%v", jobState)
-			// possible results
-			//"NOT_SUBMITTED, STARTING, RUNNING, COMPLETED, CANCELED, FAILED, CANCELLATION_REQUESTED, PLANNING, PENDING, METADATA_RETRIEVAL, QUEUED, ENGINE_START, EXECUTION_PLANNING, INVALID_STATE
-			if v == "COMPLETED" || v == "CANCELLED" || v == "FAILED" || v == "INVALID_STATE" || v == "CANCELLATION_REQUESTED" || v == "" {
-				return v, nil
-			}
-			token := fmt.Sprintf("%v", v)
-			if token == "" {
-				return "", errors.New("blank id cannot proceed")
-			}
-			lastState = v
-		} else {
-			return "", fmt.Errorf("invalid result body for id %v: %#v", id, resultMap)
-		}
+// sleep waits for the duration or until the context is done, whichever is first
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	return lastState, fmt.Errorf("query timed out after %v minutes. state was %v", h.queryTimeoutMinutes, lastState)
 }
 
+// defaults used when conf.ProtocolArgs leaves the setting at 0
+const (
+	DefaultQueryTimeout    = 60 * time.Minute
+	DefaultPollInterval    = 10 * time.Millisecond
+	DefaultMaxPollInterval = 5 * time.Second
+	DefaultCancelTimeout   = 5 * time.Minute
+	DefaultRequestTimeout  = 30 * time.Second
+)
+
 // NewHTTPEngine creates the object capable of making calls against the Dremio REST API
 func NewHTTPEngine(a conf.ProtocolArgs) (*HTTPProtocolEngine, error) {
-	client, token, err := authenticateHTTP(a)
-	if err != nil {
-		return &HTTPProtocolEngine{}, err
-	}
-	return &HTTPProtocolEngine{
-		token:               fmt.Sprintf("_dremio%v", token),
-		queryURL:            fmt.Sprintf("%v/api/v3/sql", a.URL),
-		sourceURL:           fmt.Sprintf("%v/api/v3/catalog", a.URL),
-		queryStatusURL:      fmt.Sprintf("%v/api/v3/job", a.URL),
-		client:              client,
-		queryTimeoutMinutes: 60,
-	}, nil
+	return newHTTPEngine(a, "HTTP", fmt.Sprintf("%v/api/v3", a.URL))
 }
 
-func authenticateHTTP(a conf.ProtocolArgs) (http.Client, string, error) {
-	var err error
-	client := http.Client{
-		Timeout: 30 * time.Second,
-	}
-	baseURL := a.URL
-	jsonBody := []byte(fmt.Sprintf(`{"userName": "%v", "password":"%v"}`, a.User, a.Password))
-	bodyReader := bytes.NewReader(jsonBody)
-	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%v/apiv2/login", baseURL), bodyReader)
-	if err != nil {
-		return client, "", fmt.Errorf("unable to create request: %w", err)
-	}
-	req.Header.Set("Content-Type", "application/json")
-
-	res, err := client.Do(req)
+// newHTTPEngine creates an engine for a REST API where the sql, catalog and job endpoints are under apiURL
+func newHTTPEngine(a conf.ProtocolArgs, name, apiURL string) (*HTTPProtocolEngine, error) {
+	queryTimeout := orDefault(a.Timeout, DefaultQueryTimeout)
+	client, err := newHTTPClient(a, orDefault(a.RequestTimeout, DefaultRequestTimeout))
 	if err != nil {
-		return client, "", fmt.Errorf("failed sending login request: %w", err)
+		return &HTTPProtocolEngine{}, err
 	}
-	resBody, err := io.ReadAll(res.Body)
+	token, err := authenticate(client, a)
 	if err != nil {
-		return client, "", fmt.Errorf("client: could not read response body: %w", err)
-	}
-	var resultMap map[string]interface{}
-	err = json.Unmarshal(resBody, &resultMap)
-	if err != nil {
-		return client, "", fmt.Errorf("could not read json '%v' when logging in due to error '%w'", string(resBody), err)
+		return &HTTPProtocolEngine{}, err
 	}
+	pollInterval := orDefault(a.PollInterval, DefaultPollInterval)
+	maxPollInterval := max(orDefault(a.MaxPollInterval, DefaultMaxPollInterval), pollInterval)
+	return &HTTPProtocolEngine{
+		name:            name,
+		args:            a,
+		token:           token,
+		queryURL:        fmt.Sprintf("%v/sql", apiURL),
+		sourceURL:       fmt.Sprintf("%v/catalog", apiURL),
+		queryStatusURL:  fmt.Sprintf("%v/job", apiURL),
+		client:          client,
+		queryTimeout:    queryTimeout,
+		pollInterval:    pollInterval,
+		maxPollInterval: maxPollInterval,
+		cancelTimeout:   orDefault(a.CancelTimeout, DefaultCancelTimeout),
+	}, nil
+}
 
-	if v, ok := resultMap["token"]; ok {
-		token := fmt.Sprintf("%v", v)
-		if token == "" {
-			return client, "", errors.New("blank token cannot proceed")
-		}
-		return client, token, nil
+func orDefault(d, defaultDuration time.Duration) time.Duration {
+	if d <= 0 {
+		return defaultDuration
 	}
-	return client, "", fmt.Errorf("unable to read token from %#v", resultMap)
+	return d
 }
@@ -0,0 +1,289 @@
+//	Copyright 2023 Dremio Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/conf"
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/protocol"
+)
+
+// fakeDremio answers the REST API calls the engine makes, the job reports each of the statuses in
+// turn and then keeps reporting the last one, by default the job stays RUNNING until it is canceled
+type fakeDremio struct {
+	apiPath     string // apiPath is where the sql and job endpoints are, /api/v3 when blank
+	afterCancel string // afterCancel is the status reported once the job is canceled, CANCELED when blank
+	lock        sync.Mutex
+	statuses    []string
+	polls       int
+	canceled    []string
+}
+
+func (f *fakeDremio) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	apiPath := f.apiPath
+	if apiPath == "" {
+		apiPath = "/api/v3"
+	}
+	switch {
+	case r.URL.Path == "/apiv2/login":
+		_, _ = w.Write([]byte(`{"token": "abc"}`))
+	case r.URL.Path == apiPath+"/sql":
+		_, _ = w.Write([]byte(`{"id": "job1"}`))
+	case r.URL.Path == apiPath+"/job/job1/cancel":
+		f.canceled = append(f.canceled, "job1")
+		_, _ = w.Write([]byte(`{}`))
+	case r.URL.Path == apiPath+"/job/job1":
+		f.polls++
+		status := `{"jobState": "RUNNING"}`
+		if len(f.statuses) > 0 {
+			status = f.statuses[min(f.polls, len(f.statuses))-1]
+		}
+		if len(f.canceled) > 0 {
+			status = `{"jobState": "CANCELED"}`
+			if f.afterCancel != "" {
+				status = f.afterCancel
+			}
+		}
+		_, _ = w.Write([]byte(status))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeDremio) Canceled() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]string{}, f.canceled...)
+}
+
+func newEngine(t *testing.T, handler http.Handler) *protocol.HTTPProtocolEngine {
+	t.Helper()
+	return newEngineWithArgs(t, handler, conf.ProtocolArgs{
+		Timeout: time.Second * 5,
+	})
+}
+
+func newEngineWithArgs(t *testing.T, handler http.Handler, args conf.ProtocolArgs) *protocol.HTTPProtocolEngine {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	args.User = "dremio"
+	args.Password = "dremio123"
+	args.URL = server.URL
+	eng, err := protocol.NewHTTPEngine(args)
+	if err != nil {
+		t.Fatalf("unable to setup test %v", err)
+	}
+	return eng
+}
+
+func TestExecuteCanceledByContext(t *testing.T) {
+	dremio := &fakeDremio{}
+	eng := newEngine(t, dremio)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	result, err := eng.Execute(ctx, "SELECT 1")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline to be exceeded but had %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected Execute to return when the context was done but it took %v", elapsed)
+	}
+	if result.JobID != "job1" {
+		t.Errorf("expected job id job1 but had %q", result.JobID)
+	}
+	if canceled := dremio.Canceled(); len(canceled) != 1 {
+		t.Errorf("expected the job to be canceled once but had %v", canceled)
+	}
+}
+
+func TestExecuteStatusError(t *testing.T) {
+	eng := newEngine(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/apiv2/login" {
+			_, _ = w.Write([]byte(`{"token": "abc"}`))
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"errorMessage": "Failure parsing the query."}`))
+	}))
+	_, err := eng.Execute(context.Background(), "SELEC 1")
+	var statusErr *protocol.StatusError
+	if !errors.As(err, &statusErr) {
+		t.Fatalf("expected a StatusError but had %v", err)
+	}
+	if statusErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400 but had %v", statusErr.StatusCode)
+	}
+}
+
+func TestExecuteResult(t *testing.T) {
+	dremio := &fakeDremio{statuses: []string{
+		`{"jobState": "PLANNING"}`,
+		`{"jobState": "RUNNING", "startedAt": "2023-06-01T10:00:00.100Z"}`,
+		`{
+			"jobState": "COMPLETED",
+			"rowCount": 42,
+			"startedAt": "2023-06-01T10:00:00.100Z",
+			"resourceSchedulingStartedAt": "2023-06-01T10:00:00.200Z",
+			"resourceSchedulingEndedAt": "2023-06-01T10:00:00.300Z",
+			"endedAt": "2023-06-01T10:00:01.000Z",
+			"acceleration": {"reflectionRelationships": [{"reflectionId": "r1", "relationship": "CHOSEN"}]}
+		}`,
+	}}
+	eng := newEngine(t, dremio)
+	start := time.Now()
+	result, err := eng.Execute(context.Background(), "SELECT 1")
+	if err != nil {
+		t.Fatalf("unexpected %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected a short query to finish quickly but it took %v", elapsed)
+	}
+	if result.JobID != "job1" || result.State != "COMPLETED" {
+		t.Errorf("expected job1 to be COMPLETED but had %#v", result)
+	}
+	if result.RowCount == nil || *result.RowCount != 42 {
+		t.Errorf("expected 42 rows but had %v", result.RowCount)
+	}
+	if !result.Accelerated {
+		t.Error("expected the job to be accelerated")
+	}
+	expectedStart := time.Date(2023, 6, 1, 10, 0, 0, 100000000, time.UTC)
+	if result.Start == nil || !result.Start.Equal(expectedStart) {
+		t.Errorf("expected start %v but had %v", expectedStart, result.Start)
+	}
+	if result.QueueStart == nil || result.QueueEnd == nil || result.End == nil {
+		t.Errorf("expected every timestamp but had %#v", result)
+	}
+}
+
+func TestExecuteJobError(t *testing.T) {
+	dremio := &fakeDremio{statuses: []string{
+		`{"jobState": "FAILED", "errorMessage": "VALIDATION ERROR: Table 'a.b' not found"}`,
+	}}
+	eng := newEngine(t, dremio)
+	result, err := eng.Execute(context.Background(), "SELECT * FROM a.b")
+	var jobErr *protocol.JobError
+	if !errors.As(err, &jobErr) {
+		t.Fatalf("expected a JobError but had %v", err)
+	}
+	if jobErr.JobID != "job1" || jobErr.State != "FAILED" {
+		t.Errorf("expected job1 to be FAILED but had %#v", jobErr)
+	}
+	if result.ErrorMessage != "VALIDATION ERROR: Table 'a.b' not found" {
+		t.Errorf("expected the error message of the job but had %q", result.ErrorMessage)
+	}
+}
+
+func TestExecuteTimeout(t *testing.T) {
+	dremio := &fakeDremio{}
+	eng := newEngineWithArgs(t, dremio, conf.ProtocolArgs{
+		Timeout:         200 * time.Millisecond,
+		PollInterval:    time.Millisecond,
+		MaxPollInterval: 20 * time.Millisecond,
+	})
+	_, err := eng.Execute(context.Background(), "SELECT 1")
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected the query to time out but had %v", err)
+	}
+	dremio.lock.Lock()
+	defer dremio.lock.Unlock()
+	// 1+2+4+8+16 ms and then every 20ms, far fewer than polling every millisecond, and then once more for the cancel
+	if dremio.polls < 6 || dremio.polls > 21 {
+		t.Errorf("expected the polling to back off but the job was polled %v times", dremio.polls)
+	}
+}
+
+func TestExecuteRequestTimeout(t *testing.T) {
+	stalled := make(chan struct{})
+	eng := newEngineWithArgs(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/apiv2/login" {
+			_, _ = w.Write([]byte(`{"token": "abc"}`))
+			return
+		}
+		// the response does not come until the test is over
+		<-stalled
+	}), conf.ProtocolArgs{
+		Timeout:        time.Minute,
+		RequestTimeout: 100 * time.Millisecond,
+	})
+	// cleanups run last in first, so the handler returns before the server is closed
+	t.Cleanup(func() { close(stalled) })
+	start := time.Now()
+	_, err := eng.Execute(context.Background(), "SELECT 1")
+	if err == nil {
+		t.Fatal("expected the stalled request to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the stalled request to be cut off after the request timeout but it took %v", elapsed)
+	}
+}
+
+func TestExecuteTimeoutCancelsJob(t *testing.T) {
+	tests := []struct {
+		name        string
+		afterCancel string
+		state       string
+		canceled    bool
+		completed   bool
+	}{
+		{name: "canceled", state: "CANCELED", canceled: true},
+		{name: "still running", afterCancel: `{"jobState": "CANCELLATION_REQUESTED"}`, state: "CANCELLATION_REQUESTED"},
+		{name: "completed first", afterCancel: `{"jobState": "COMPLETED", "rowCount": 1}`, state: "COMPLETED", completed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dremio := &fakeDremio{afterCancel: tt.afterCancel}
+			eng := newEngineWithArgs(t, dremio, conf.ProtocolArgs{
+				Timeout:         50 * time.Millisecond,
+				CancelTimeout:   100 * time.Millisecond,
+				PollInterval:    time.Millisecond,
+				MaxPollInterval: 10 * time.Millisecond,
+			})
+			result, err := eng.Execute(context.Background(), "SELECT 1")
+			if canceled := dremio.Canceled(); len(canceled) != 1 {
+				t.Errorf("expected the job to be canceled once but was %v", canceled)
+			}
+			if result.State != tt.state {
+				t.Errorf("expected state %v but was %v", tt.state, result.State)
+			}
+			if tt.completed {
+				if err != nil {
+					t.Errorf("expected the job that completed to succeed but had %v", err)
+				}
+				return
+			}
+			var timeoutErr *protocol.TimeoutError
+			if !errors.As(err, &timeoutErr) {
+				t.Fatalf("expected a TimeoutError but had %v", err)
+			}
+			if timeoutErr.Canceled != tt.canceled || timeoutErr.JobID != "job1" {
+				t.Errorf("expected job1 with canceled %v but was %v with canceled %v", tt.canceled, timeoutErr.JobID, timeoutErr.Canceled)
+			}
+		})
+	}
+}
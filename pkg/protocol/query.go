@@ -0,0 +1,57 @@
+//	Copyright 2023 Dremio Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"context"
+
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/parser"
+)
+
+// Query is a query with the path it runs in and the versions of the sources it runs against
+type Query struct {
+	SQL        string
+	Context    []string             // Context is the path unqualified names are resolved in, such as [space folder]
+	References map[string]Reference // References maps a versioned source, such as a Nessie or Arctic catalog, to its version
+}
+
+// Reference is a branch, tag or commit of a versioned source
+type Reference struct {
+	Type  string `json:"type"` // Type is BRANCH, TAG or COMMIT
+	Value string `json:"value"`
+}
+
+// QueryExecutor is implemented by engines that can run a query in a context and against versioned references
+type QueryExecutor interface {
+	ExecuteQuery(ctx context.Context, q Query) (Result, error)
+}
+
+// ParseContext reads a dotted path such as space.folder, see parser.ParseContext
+func ParseContext(path string) ([]string, error) {
+	return parser.ParseContext(path)
+}
+
+// ParseReferences reads a comma separated list of source=type:value, see parser.ParseReferences
+func ParseReferences(list string) (map[string]Reference, error) {
+	parsed, err := parser.ParseReferences(list)
+	if err != nil || parsed == nil {
+		return nil, err
+	}
+	references := make(map[string]Reference, len(parsed))
+	for source, ref := range parsed {
+		references[source] = Reference{Type: ref.Type, Value: ref.Value}
+	}
+	return references, nil
+}
@@ -0,0 +1,79 @@
+//	Copyright 2023 Dremio Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/protocol"
+)
+
+// recordingSQL keeps the body of the last submission to the SQL API before passing the request on
+type recordingSQL struct {
+	next http.Handler
+	body []byte
+}
+
+func (r *recordingSQL) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/api/v3/sql" {
+		r.body, _ = io.ReadAll(req.Body)
+		req.Body = io.NopCloser(bytes.NewReader(r.body))
+	}
+	r.next.ServeHTTP(w, req)
+}
+
+func TestExecuteQuerySendsContextAndReferences(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    protocol.Query
+		expected string
+	}{
+		{name: "plain", query: protocol.Query{SQL: "SELECT 1"}, expected: `{"sql":"SELECT 1"}`},
+		{
+			name: "context and references",
+			query: protocol.Query{
+				SQL:        "SELECT * FROM t",
+				Context:    []string{"lake", "sales"},
+				References: map[string]protocol.Reference{"lake": {Type: "BRANCH", Value: "dev"}},
+			},
+			expected: `{"sql":"SELECT * FROM t","context":["lake","sales"],"references":{"lake":{"type":"BRANCH","value":"dev"}}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := &recordingSQL{next: &fakeDremio{statuses: []string{`{"jobState": "COMPLETED"}`}}}
+			eng := newEngine(t, recorder)
+			if _, err := eng.ExecuteQuery(context.Background(), tt.query); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var expected, actual interface{}
+			if err := json.Unmarshal([]byte(tt.expected), &expected); err != nil {
+				t.Fatalf("invalid test: %v", err)
+			}
+			if err := json.Unmarshal(recorder.body, &actual); err != nil {
+				t.Fatalf("invalid body %q: %v", recorder.body, err)
+			}
+			if !reflect.DeepEqual(expected, actual) {
+				t.Errorf("expected body %v but had %s", tt.expected, recorder.body)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+//	Copyright 2023 Dremio Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// DefaultResultPageSize is the number of rows read per request, the most Dremio returns at once
+const DefaultResultPageSize = 500
+
+// Column of a job's results, Type is the Dremio type name such as VARCHAR or BIGINT
+type Column struct {
+	Name string
+	Type string
+}
+
+// ResultPage is one page of a job's results, each row maps the column name to its JSON encoded value
+type ResultPage struct {
+	Schema []Column
+	Rows   []map[string]json.RawMessage
+}
+
+// ResultReader is implemented by engines that can read back the rows of a completed job
+type ResultReader interface {
+	ReadResults(ctx context.Context, jobID string, page func(ResultPage) error) error
+}
+
+// ResultStreamer is implemented by engines that hand back the rows of a query while it runs, page is called
+// for every batch of rows and the query fails when page returns an error
+type ResultStreamer interface {
+	ExecuteStreaming(ctx context.Context, query string, page func(ResultPage) error) (Result, error)
+}
+
+// resultsResponse is the body of /job/{id}/results
+type resultsResponse struct {
+	RowCount int64 `json:"rowCount"`
+	Schema   []struct {
+		Name string `json:"name"`
+		Type struct {
+			Name string `json:"name"`
+		} `json:"type"`
+	} `json:"schema"`
+	Rows []map[string]json.RawMessage `json:"rows"`
+}
+
+// ReadResults pages through the results of the completed job and passes each page to page, there is always
+// at least one page so the schema is known even when the job returned no rows
+func (h *HTTPProtocolEngine) ReadResults(ctx context.Context, jobID string, page func(ResultPage) error) error {
+	var offset int64
+	for {
+		var res resultsResponse
+		url := fmt.Sprintf("%v/%v/results?offset=%v&limit=%v", h.queryStatusURL, jobID, offset, DefaultResultPageSize)
+		if err := h.do(ctx, http.MethodGet, url, nil, &res); err != nil {
+			return fmt.Errorf("unable to read results of job %v at row %v: %w", jobID, offset, err)
+		}
+		schema := make([]Column, len(res.Schema))
+		for i, c := range res.Schema {
+			schema[i] = Column{Name: c.Name, Type: c.Type.Name}
+		}
+		if err := page(ResultPage{Schema: schema, Rows: res.Rows}); err != nil {
+			return err
+		}
+		offset += int64(len(res.Rows))
+		if len(res.Rows) == 0 || offset >= res.RowCount {
+			return nil
+		}
+	}
+}
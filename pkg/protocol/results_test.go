@@ -0,0 +1,113 @@
+//	Copyright 2023 Dremio Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/protocol"
+)
+
+// pagedResults serves the results of job1, the given number of rows with a single column n
+type pagedResults struct {
+	rows    int
+	lock    sync.Mutex
+	offsets []int
+}
+
+func (p *pagedResults) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.URL.Path {
+	case "/apiv2/login":
+		_, _ = w.Write([]byte(`{"token": "abc"}`))
+	case "/api/v3/job/job1/results":
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		p.lock.Lock()
+		p.offsets = append(p.offsets, offset)
+		p.lock.Unlock()
+		rows := []string{}
+		for n := offset; n < min(offset+limit, p.rows); n++ {
+			rows = append(rows, fmt.Sprintf(`{"n": %v}`, n))
+		}
+		fmt.Fprintf(w, `{"rowCount": %v, "schema": [{"name": "n", "type": {"name": "BIGINT"}}], "rows": [%v]}`, p.rows, strings.Join(rows, ","))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestReadResults(t *testing.T) {
+	tests := []struct {
+		rows    int
+		offsets []int
+	}{
+		{rows: 0, offsets: []int{0}},
+		{rows: 3, offsets: []int{0}},
+		{rows: 1001, offsets: []int{0, 500, 1000}},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.rows), func(t *testing.T) {
+			results := &pagedResults{rows: tt.rows}
+			eng := newEngine(t, results)
+			var read []int64
+			err := eng.ReadResults(context.Background(), "job1", func(page protocol.ResultPage) error {
+				expected := []protocol.Column{{Name: "n", Type: "BIGINT"}}
+				if !reflect.DeepEqual(expected, page.Schema) {
+					t.Errorf("expected schema %v but was %v", expected, page.Schema)
+				}
+				for _, row := range page.Rows {
+					var n int64
+					if err := json.Unmarshal(row["n"], &n); err != nil {
+						return err
+					}
+					read = append(read, n)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(read) != tt.rows {
+				t.Errorf("expected %v rows but read %v", tt.rows, len(read))
+			}
+			for i, n := range read {
+				if n != int64(i) {
+					t.Fatalf("expected row %v to be %v but was %v", i, i, n)
+				}
+			}
+			if !reflect.DeepEqual(tt.offsets, results.offsets) {
+				t.Errorf("expected pages at offsets %v but were %v", tt.offsets, results.offsets)
+			}
+		})
+	}
+}
+
+func TestReadResultsStatusError(t *testing.T) {
+	eng := newEngine(t, &fakeDremio{})
+	err := eng.ReadResults(context.Background(), "missing", func(protocol.ResultPage) error { return nil })
+	var statusErr *protocol.StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound {
+		t.Errorf("expected a 404 StatusError but was %v", err)
+	}
+}
@@ -0,0 +1,145 @@
+//	Copyright 2023 Dremio Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/conf"
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/parser"
+)
+
+// SQLProtocolEngine runs queries with a database/sql driver, so the same batches can be dry-run against a
+// local database or run against any system with a Go driver. The driver must be registered by importing it
+type SQLProtocolEngine struct {
+	db           *sql.DB
+	driver       string
+	queryTimeout time.Duration
+}
+
+// NewSQLEngine opens the DSN of the args with the driver and checks that the database can be reached
+func NewSQLEngine(a conf.ProtocolArgs) (*SQLProtocolEngine, error) {
+	if a.Driver == "" {
+		return &SQLProtocolEngine{}, errors.New("a database/sql driver name is required")
+	}
+	db, err := sql.Open(a.Driver, a.DSN)
+	if err != nil {
+		return &SQLProtocolEngine{}, fmt.Errorf("unable to open database with driver %v: %w", a.Driver, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return &SQLProtocolEngine{}, fmt.Errorf("unable to connect to database with driver %v: %w", a.Driver, err)
+	}
+	return &SQLProtocolEngine{
+		db:           db,
+		driver:       a.Driver,
+		queryTimeout: orDefault(a.Timeout, DefaultQueryTimeout),
+	}, nil
+}
+
+// Name of the protocol
+func (e *SQLProtocolEngine) Name() string {
+	return "database/sql " + e.driver
+}
+
+// Execute runs the query, the row count of the result is the number of rows read for statements that return
+// rows and the number of rows affected for the others, when the driver reports it. database/sql has no job ids
+// so the result has none
+func (e *SQLProtocolEngine) Execute(ctx context.Context, query string) (Result, error) {
+	queryCtx, cancel := context.WithTimeout(ctx, e.queryTimeout)
+	defer cancel()
+	start := time.Now()
+	result := Result{Start: &start}
+	var count *int64
+	var err error
+	if parser.ReturnsRows(query) {
+		count, err = e.query(queryCtx, query)
+	} else {
+		count, err = e.exec(queryCtx, query)
+	}
+	if err != nil {
+		return e.failed(ctx, queryCtx, result, err)
+	}
+	end := time.Now()
+	result.End = &end
+	result.State = "COMPLETED"
+	result.RowCount = count
+	return result, nil
+}
+
+// query reads every row the query returns and counts them
+func (e *SQLProtocolEngine) query(ctx context.Context, query string) (*int64, error) {
+	rows, err := e.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var count int64
+	for rows.Next() {
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	return &count, nil
+}
+
+// exec runs a statement that returns no rows, the count is nil when the driver does not report the rows affected
+func (e *SQLProtocolEngine) exec(ctx context.Context, query string) (*int64, error) {
+	res, err := e.db.ExecContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return nil, nil
+	}
+	return &count, nil
+}
+
+// failed describes a query that did not complete, telling a timeout or the caller giving up apart from an error of the database
+func (e *SQLProtocolEngine) failed(ctx, queryCtx context.Context, result Result, err error) (Result, error) {
+	end := time.Now()
+	result.End = &end
+	if ctx.Err() != nil {
+		result.State = "CANCELED"
+		return result, ctx.Err()
+	}
+	if queryCtx.Err() != nil {
+		result.State = "CANCELED"
+		// the driver stops the query before returning once its context is done
+		return result, &TimeoutError{Timeout: e.queryTimeout, State: "RUNNING", Canceled: true}
+	}
+	result.State = "FAILED"
+	result.ErrorMessage = err.Error()
+	return result, err
+}
+
+// Close closes the database
+func (e *SQLProtocolEngine) Close() error {
+	if e.db == nil {
+		return nil
+	}
+	return e.db.Close()
+}
@@ -0,0 +1,118 @@
+//	Copyright 2023 Dremio Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/conf"
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/protocol"
+)
+
+// endless never finishes on its own
+const endless = "WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x + 1 FROM c) SELECT count(*) FROM c"
+
+func newSQLEngine(t *testing.T, timeout time.Duration) *protocol.SQLProtocolEngine {
+	t.Helper()
+	eng, err := protocol.NewSQLEngine(conf.ProtocolArgs{
+		Driver:  "sqlite",
+		DSN:     filepath.Join(t.TempDir(), "test.db"),
+		Timeout: timeout,
+	})
+	if err != nil {
+		t.Fatalf("unable to create engine: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := eng.Close(); err != nil {
+			t.Errorf("unable to close engine: %v", err)
+		}
+	})
+	return eng
+}
+
+func TestSQLExecute(t *testing.T) {
+	eng := newSQLEngine(t, 0)
+	if _, err := eng.Execute(context.Background(), "CREATE TABLE t (n INTEGER)"); err != nil {
+		t.Fatalf("unable to create table: %v", err)
+	}
+	result, err := eng.Execute(context.Background(), "INSERT INTO t VALUES (1), (2), (3)")
+	if err != nil {
+		t.Fatalf("unable to insert: %v", err)
+	}
+	if result.RowCount == nil || *result.RowCount != 3 {
+		t.Errorf("expected 3 rows affected but was %v", result.RowCount)
+	}
+	result, err = eng.Execute(context.Background(), "SELECT n FROM t")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.State != "COMPLETED" {
+		t.Errorf("expected state COMPLETED but was %v", result.State)
+	}
+	if result.RowCount == nil || *result.RowCount != 3 {
+		t.Errorf("expected 3 rows but was %v", result.RowCount)
+	}
+	if result.Start == nil || result.End == nil {
+		t.Errorf("expected start and end times but were %v and %v", result.Start, result.End)
+	}
+}
+
+func TestSQLExecuteError(t *testing.T) {
+	eng := newSQLEngine(t, 0)
+	result, err := eng.Execute(context.Background(), "SELECT n FROM missing")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if result.State != "FAILED" || result.ErrorMessage != err.Error() {
+		t.Errorf("expected a FAILED result with the error but was %v: %v", result.State, result.ErrorMessage)
+	}
+}
+
+func TestSQLExecuteCanceledByContext(t *testing.T) {
+	eng := newSQLEngine(t, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	result, err := eng.Execute(ctx, endless)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the context error but was %v", err)
+	}
+	if result.State != "CANCELED" {
+		t.Errorf("expected state CANCELED but was %v", result.State)
+	}
+}
+
+func TestSQLExecuteTimeout(t *testing.T) {
+	eng := newSQLEngine(t, 100*time.Millisecond)
+	_, err := eng.Execute(context.Background(), endless)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected a timeout but was %v", err)
+	}
+}
+
+func TestSQLEngineRequiresDriver(t *testing.T) {
+	if _, err := protocol.NewSQLEngine(conf.ProtocolArgs{DSN: "test.db"}); err == nil {
+		t.Error("expected an error without a driver")
+	}
+	if _, err := protocol.NewSQLEngine(conf.ProtocolArgs{Driver: "missing"}); err == nil {
+		t.Error("expected an error for a driver that is not registered")
+	}
+}
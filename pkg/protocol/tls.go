@@ -0,0 +1,101 @@
+//	Copyright 2023 Dremio Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/conf"
+)
+
+// tlsVersions are the names accepted for the minimum TLS version
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion converts a version such as 1.2 to its crypto/tls constant, a blank version is 0
+// which leaves the choice to crypto/tls
+func ParseTLSVersion(version string) (uint16, error) {
+	if version == "" {
+		return 0, nil
+	}
+	v, ok := tlsVersions[version]
+	if !ok {
+		return 0, fmt.Errorf("unsupported TLS version '%v', use one of 1.0, 1.1, 1.2 or 1.3", version)
+	}
+	return v, nil
+}
+
+// newTLSConfig builds the TLS configuration for connections to Dremio from the protocol args
+func newTLSConfig(a conf.ProtocolArgs) (*tls.Config, error) {
+	minVersion, err := ParseTLSVersion(a.TLSMinVersion)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		InsecureSkipVerify: a.SkipSSL,
+		MinVersion:         minVersion,
+		ServerName:         a.TLSServerName,
+	}
+	if a.CACertFile != "" {
+		pem, err := os.ReadFile(a.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA certificate file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates found in CA certificate file %v", a.CACertFile)
+		}
+		config.RootCAs = pool
+	}
+	if (a.ClientCertFile == "") != (a.ClientKeyFile == "") {
+		return nil, errors.New("a client certificate and its key must be configured together")
+	}
+	if a.ClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(a.ClientCertFile, a.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// newHTTPClient creates the client used for every call to Dremio, each request is limited to the timeout
+// while the query timeout is enforced separately by the polling
+func newHTTPClient(a conf.ProtocolArgs, timeout time.Duration) (http.Client, error) {
+	config, err := newTLSConfig(a)
+	if err != nil {
+		return http.Client{}, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+	}, nil
+}
@@ -0,0 +1,124 @@
+//	Copyright 2023 Dremio Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/conf"
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/protocol"
+)
+
+func writePEM(t *testing.T, name, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatalf("unable to setup test %v", err)
+	}
+	return path
+}
+
+// newClientCert creates a self signed client certificate and returns it along with its PEM files
+func newClientCert(t *testing.T) (*x509.Certificate, string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to setup test %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "batch"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unable to setup test %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("unable to setup test %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("unable to setup test %v", err)
+	}
+	return cert, writePEM(t, "client.pem", "CERTIFICATE", der), writePEM(t, "client-key.pem", "EC PRIVATE KEY", keyDER)
+}
+
+func newTLSServer(t *testing.T, clientCA *x509.Certificate) *httptest.Server {
+	t.Helper()
+	server := httptest.NewUnstartedServer(&fakeDremio{})
+	if clientCA != nil {
+		pool := x509.NewCertPool()
+		pool.AddCert(clientCA)
+		server.TLS = &tls.Config{
+			ClientAuth: tls.RequireAndVerifyClientCert,
+			ClientCAs:  pool,
+		}
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestTLS(t *testing.T) {
+	clientCert, clientCertFile, clientKeyFile := newClientCert(t)
+	plain := newTLSServer(t, nil)
+	mutual := newTLSServer(t, clientCert)
+	caFile := writePEM(t, "ca.pem", "CERTIFICATE", plain.Certificate().Raw)
+	tests := []struct {
+		name  string
+		url   string
+		args  conf.ProtocolArgs
+		valid bool
+	}{
+		{name: "untrusted certificate", url: plain.URL, valid: false},
+		{name: "skip verify", url: plain.URL, args: conf.ProtocolArgs{SkipSSL: true}, valid: true},
+		{name: "ca bundle", url: plain.URL, args: conf.ProtocolArgs{CACertFile: caFile}, valid: true},
+		{name: "wrong server name", url: plain.URL, args: conf.ProtocolArgs{CACertFile: caFile, TLSServerName: "dremio.internal"}, valid: false},
+		{name: "server name", url: plain.URL, args: conf.ProtocolArgs{CACertFile: caFile, TLSServerName: "example.com"}, valid: true},
+		{name: "min version", url: plain.URL, args: conf.ProtocolArgs{CACertFile: caFile, TLSMinVersion: "1.3"}, valid: true},
+		{name: "missing client certificate", url: mutual.URL, args: conf.ProtocolArgs{CACertFile: caFile}, valid: false},
+		{name: "client certificate", url: mutual.URL, args: conf.ProtocolArgs{CACertFile: caFile, ClientCertFile: clientCertFile, ClientKeyFile: clientKeyFile}, valid: true},
+		{name: "client certificate without key", url: mutual.URL, args: conf.ProtocolArgs{CACertFile: caFile, ClientCertFile: clientCertFile}, valid: false},
+		{name: "unknown version", url: plain.URL, args: conf.ProtocolArgs{CACertFile: caFile, TLSMinVersion: "2"}, valid: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.args.URL = tt.url
+			_, err := protocol.NewHTTPEngine(tt.args)
+			if tt.valid && err != nil {
+				t.Errorf("unexpected %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+//	Copyright 2023 Dremio Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retry
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc/codes"
+
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/protocol"
+)
+
+// Policy decides how many times a query is attempted and how long to wait between attempts
+type Policy struct {
+	MaxAttempts    int           // MaxAttempts is the total number of attempts including the first, below 1 is 1
+	InitialBackoff time.Duration // InitialBackoff is the wait before the second attempt, it doubles for every attempt after that
+	MaxBackoff     time.Duration // MaxBackoff caps the wait between attempts, 0 caps it at an hour
+}
+
+// Attempts is the total number of attempts the policy allows
+func (p Policy) Attempts() int {
+	if p.MaxAttempts < 1 {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+// Backoff is how long to wait after the given failed attempt, counting from 1. The wait doubles with each
+// attempt and then a random amount of up to half of it is taken off so that threads which failed
+// together do not all retry at the same moment
+func (p Policy) Backoff(attempt int) time.Duration {
+	if p.InitialBackoff <= 0 {
+		return 0
+	}
+	d := p.InitialBackoff
+	for i := 1; i < attempt && d < maxBackoff(p); i++ {
+		d *= 2
+	}
+	d = min(d, maxBackoff(p))
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+	return d - time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// maxBackoff is the cap on the wait between attempts, an hour when the policy has none
+func maxBackoff(p Policy) time.Duration {
+	if p.MaxBackoff <= 0 {
+		return time.Hour
+	}
+	return p.MaxBackoff
+}
+
+// permanentMessages are found in the errors Dremio reports for queries that will fail no matter how
+// often they are attempted
+var permanentMessages = []string{
+	"validation error",
+	"parse error",
+	"permission error",
+	"permission denied",
+	"access denied",
+	"not authorized",
+	"unauthorized",
+}
+
+// transientMessages are found in the errors Dremio reports for queries that may succeed when attempted again,
+// they take precedence over permanentMessages
+var transientMessages = []string{
+	"concurrent_modification",
+	"concurrent modification",
+	"concurrent update",
+	"concurrent operation",
+	"out of memory",
+	"connection reset",
+	"timed out",
+}
+
+// Retryable is false when err is known to fail again on every attempt, such as a query that does not
+// parse or is not permitted. HTTP 5xx and 429 responses, connection resets, timeouts and Iceberg
+// concurrent commit conflicts are retryable, as is any error that cannot be classified. Flight SQL errors are
+// classified by their gRPC code. A query that timed out is only retryable once it is known to be canceled
+func Retryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var timeoutErr *protocol.TimeoutError
+	if errors.As(err, &timeoutErr) {
+		// another attempt must not run next to a query that may still be running
+		return timeoutErr.Canceled
+	}
+	var statusErr *protocol.StatusError
+	if errors.As(err, &statusErr) {
+		switch {
+		case statusErr.StatusCode >= 500,
+			statusErr.StatusCode == http.StatusTooManyRequests,
+			statusErr.StatusCode == http.StatusRequestTimeout:
+			return true
+		case statusErr.StatusCode >= 400:
+			return hasAny(statusErr.Body, transientMessages)
+		}
+	}
+	var rpcErr *protocol.RPCError
+	if errors.As(err, &rpcErr) {
+		switch rpcErr.Code {
+		case codes.Unavailable, codes.ResourceExhausted, codes.Aborted, codes.DeadlineExceeded:
+			return true
+		case codes.InvalidArgument, codes.PermissionDenied, codes.Unauthenticated, codes.NotFound,
+			codes.AlreadyExists, codes.FailedPrecondition, codes.Unimplemented, codes.OutOfRange:
+			return hasAny(rpcErr.Message, transientMessages)
+		}
+	}
+	if errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.EOF) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	if hasAny(err.Error(), transientMessages) {
+		return true
+	}
+	return !hasAny(err.Error(), permanentMessages)
+}
+
+func hasAny(s string, substrings []string) bool {
+	s = strings.ToLower(s)
+	for _, sub := range substrings {
+		if strings.Contains(s, sub) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+//	Copyright 2023 Dremio Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retry_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/protocol"
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/retry"
+)
+
+func TestBackoff(t *testing.T) {
+	policy := retry.Policy{
+		MaxAttempts:    10,
+		InitialBackoff: time.Second,
+		MaxBackoff:     5 * time.Second,
+	}
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{attempt: 1, max: time.Second},
+		{attempt: 2, max: 2 * time.Second},
+		{attempt: 3, max: 4 * time.Second},
+		{attempt: 4, max: 5 * time.Second},
+		{attempt: 40, max: 5 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("attempt %v", tt.attempt), func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				d := policy.Backoff(tt.attempt)
+				if d > tt.max || d < tt.max/2 {
+					t.Fatalf("expected a backoff between %v and %v but had %v", tt.max/2, tt.max, d)
+				}
+			}
+		})
+	}
+}
+
+func TestBackoffDisabled(t *testing.T) {
+	if d := (retry.Policy{MaxAttempts: 3}).Backoff(2); d != 0 {
+		t.Errorf("expected no backoff but had %v", d)
+	}
+}
+
+func TestAttempts(t *testing.T) {
+	if a := (retry.Policy{}).Attempts(); a != 1 {
+		t.Errorf("expected 1 attempt but had %v", a)
+	}
+	if a := (retry.Policy{MaxAttempts: 3, InitialBackoff: time.Second}).Attempts(); a != 3 {
+		t.Errorf("expected 3 attempts but had %v", a)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		retryable bool
+	}{
+		{name: "server error", err: &protocol.StatusError{StatusCode: 503}, retryable: true},
+		{name: "too many requests", err: &protocol.StatusError{StatusCode: 429}, retryable: true},
+		{name: "bad request", err: &protocol.StatusError{StatusCode: 400, Body: `{"errorMessage":"Failure parsing the query."}`}, retryable: false},
+		{name: "forbidden", err: &protocol.StatusError{StatusCode: 403}, retryable: false},
+		{name: "connection reset", err: fmt.Errorf("failed sending request: %w", syscall.ECONNRESET), retryable: true},
+		{name: "unexpected eof", err: fmt.Errorf("failed sending request: %w", io.ErrUnexpectedEOF), retryable: true},
+		{name: "deadline", err: fmt.Errorf("failed sending request: %w", context.DeadlineExceeded), retryable: true},
+		{name: "canceled", err: fmt.Errorf("failed sending request: %w", context.Canceled), retryable: false},
+		{name: "validation", err: &protocol.JobError{State: "FAILED", Message: "VALIDATION ERROR: Table 'a.b' not found"}, retryable: false},
+		{name: "parse", err: &protocol.JobError{State: "FAILED", Message: "PARSE ERROR: Encountered \"SELEC\""}, retryable: false},
+		{name: "permission", err: &protocol.JobError{State: "FAILED", Message: "PERMISSION ERROR: user does not have privileges"}, retryable: false},
+		{name: "iceberg conflict", err: &protocol.JobError{State: "FAILED", Message: "CONCURRENT_MODIFICATION ERROR: Unable to refresh metadata for the dataset (due to concurrent updates)"}, retryable: true},
+		{name: "iceberg commit", err: &protocol.JobError{State: "FAILED", Message: "org.apache.iceberg.exceptions.CommitFailedException: Permission denied while committing"}, retryable: false},
+		{name: "unknown job failure", err: &protocol.JobError{State: "FAILED"}, retryable: true},
+		{name: "flight unavailable", err: &protocol.RPCError{Code: codes.Unavailable, Message: "connection refused"}, retryable: true},
+		{name: "flight invalid", err: &protocol.RPCError{Code: codes.InvalidArgument, Message: "Failure parsing the query."}, retryable: false},
+		{name: "flight unauthenticated", err: &protocol.RPCError{Code: codes.Unauthenticated}, retryable: false},
+		{name: "flight conflict", err: &protocol.RPCError{Code: codes.FailedPrecondition, Message: "CONCURRENT_MODIFICATION ERROR: concurrent updates"}, retryable: true},
+		{name: "timeout canceled", err: &protocol.TimeoutError{JobID: "1", State: "RUNNING", Canceled: true}, retryable: true},
+		{name: "timeout still running", err: &protocol.TimeoutError{JobID: "1", State: "RUNNING"}, retryable: false},
+		{name: "unknown", err: errors.New("something went wrong"), retryable: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if actual := retry.Retryable(tt.err); actual != tt.retryable {
+				t.Errorf("expected retryable to be %v for `%v` but was %v", tt.retryable, tt.err, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+//	Copyright 2023 Dremio Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package throttle_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rsvihladremio/dremio-batch-execute/pkg/throttle"
+)
+
+func TestLimiterAllowsBurst(t *testing.T) {
+	l := throttle.NewLimiter(1, 5)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := l.Wait(context.Background()); err != nil {
+			t.Fatalf("unexpected %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected the burst to not wait but it took %v", elapsed)
+	}
+}
+
+func TestLimiterIsSharedByThreads(t *testing.T) {
+	perSecond := 100.0
+	l := throttle.NewLimiter(perSecond, 1)
+	start := time.Now()
+	wg := sync.WaitGroup{}
+	for thread := 0; thread < 4; thread++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 5; i++ {
+				if err := l.Wait(context.Background()); err != nil {
+					t.Errorf("unexpected %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	// 20 queries with a burst of 1 need at least 19 intervals
+	minimum := time.Duration(19 / perSecond * float64(time.Second))
+	if elapsed := time.Since(start); elapsed < minimum {
+		t.Errorf("expected at least %v for 20 queries but took %v", minimum, elapsed)
+	}
+}
+
+func TestLimiterWaitIsCancelled(t *testing.T) {
+	l := throttle.NewLimiter(0.001, 1)
+	if err := l.Wait(context.Background()); err != nil {
+		t.Fatalf("unexpected %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.Wait(ctx); err == nil {
+		t.Error("expected the wait to be cancelled")
+	}
+}
+
+func TestNilLimiterAllowsEverything(t *testing.T) {
+	var l *throttle.Limiter
+	if err := l.Wait(context.Background()); err != nil {
+		t.Fatalf("unexpected %v", err)
+	}
+}